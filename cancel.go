@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Cancellation and timeouts of video processing. Every queued video has a
+// context that is cancelled if the video is deleted, and every transcoder run
+// gets a deadline derived from the duration of the video so a file that makes
+// the transcoder hang can't occupy a worker forever.
+
+// Videos that are queued or being processed, a video can't be processed by
+// multiple workers at the same time so the token is enough as the key
+var activeVideos = make(map[string]*videoToTranscode)
+var activeVideosMutex sync.Mutex
+
+// Allowed transcoding time per second of video and per encoder pass
+var transcodeTimeoutFactor float64 = 10.0
+
+// Transcoding time that is allowed in addition to the above, also the time
+// limit for generating thumbnails
+var minTranscodeTimeout time.Duration = 5 * time.Minute
+
+// Time limit for a transcoder run if the duration of the video is not known
+const unknownDurationTimeout = 1 * time.Hour
+
+var errTranscodeTimeout = errors.New("Transcoding took too long")
+
+// Register the video as being processed so it can be cancelled
+func activateVideo(video *videoToTranscode) {
+	activeVideosMutex.Lock()
+	defer activeVideosMutex.Unlock()
+
+	activeVideos[video.token] = video
+}
+
+// Register the video as being processed unless there is already another video
+// with the same token, returns false if there is
+func activateIdleVideo(video *videoToTranscode) bool {
+	activeVideosMutex.Lock()
+	defer activeVideosMutex.Unlock()
+
+	if _, ok := activeVideos[video.token]; ok {
+		return false
+	}
+	activeVideos[video.token] = video
+	return true
+}
+
+// Unregister the video when processing ends and release its context
+func deactivateVideo(video *videoToTranscode) {
+	activeVideosMutex.Lock()
+	defer activeVideosMutex.Unlock()
+
+	if activeVideos[video.token] == video {
+		delete(activeVideos, video.token)
+	}
+	video.cancel()
+}
+
+// Cancel the processing of the video `token`, kills the running transcoder
+// and prevents any further work. Waits until the worker has stopped so it
+// won't store any more files. Returns false if the video is not active.
+func cancelVideo(token string) bool {
+	activeVideosMutex.Lock()
+	video, ok := activeVideos[token]
+	if ok {
+		log.Printf("%s: Cancelling processing", video.srcPath)
+		video.cancel()
+		delete(activeVideos, token)
+	}
+	activeVideosMutex.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	// A queued video stops as soon as a worker picks it up
+	video.processing.Lock()
+	video.processing.Unlock()
+	return true
+}
+
+// Returns the owner of the active video `token`, false if it's not active
+func activeVideoOwner(token string) (string, bool) {
+	activeVideosMutex.Lock()
+	defer activeVideosMutex.Unlock()
+
+	video, ok := activeVideos[token]
+	if !ok {
+		return "", false
+	}
+	return video.owner, true
+}
+
+// Returns true if the video was deleted while it was queued or processed
+func isVideoCancelled(video *videoToTranscode) bool {
+	return video.ctx.Err() == context.Canceled
+}
+
+// Returns a context for a transcoder run that makes `passes` encoding passes
+// over the video, expires if it takes unreasonably long
+func transcodeContext(video *videoToTranscode, passes int) (context.Context, context.CancelFunc) {
+	timeout := unknownDurationTimeout
+	if video.duration > 0.0 {
+		perPass := time.Duration(video.duration * transcodeTimeoutFactor * float64(time.Second))
+		timeout = minTranscodeTimeout + perPass*time.Duration(passes)
+	}
+
+	return context.WithTimeout(video.ctx, timeout)
+}
+
+// Returns a context for a transcoder run done while handling the request `r`,
+// cancelled if either the video is deleted or the request ends
+func requestTranscodeContext(video *videoToTranscode, r *http.Request) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(video.ctx, minTranscodeTimeout)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// Replace the error of an expired transcoder run with a descriptive one
+func transcodeTimeoutError(err error) error {
+	if err == context.DeadlineExceeded {
+		return errTranscodeTimeout
+	}
+	return err
+}
@@ -0,0 +1,295 @@
+package jobstatus
+
+import (
+	"sync"
+	"time"
+)
+
+// Processing state of a single uploaded video
+type State string
+
+const (
+	// Waiting for a free worker in a process queue
+	StateQueued State = "queued"
+
+	// The video data is still being uploaded by the client
+	StateDownloading State = "downloading"
+
+	// The fast pass is generating the thumbnail and low quality version
+	StateFastTranscoding State = "fast-transcoding"
+
+	// The low quality version is served, waiting for the slow pass
+	StateLowQualityReady State = "low-quality-ready"
+
+	// The slow pass is transcoding the high quality version
+	StateSlowTranscoding State = "slow-transcoding"
+
+	// The high quality version is served, nothing left to do
+	StateDone State = "done"
+
+	// Processing stopped because of an error, see `Status.Error`
+	StateFailed State = "failed"
+)
+
+// Returns true if no more work will be done for a video in `state`
+func (state State) IsFinished() bool {
+	return state == StateDone || state == StateFailed
+}
+
+// URLs of the files served for a video, optional outputs are empty if disabled
+type Outputs struct {
+	Video     string `json:"video,omitempty"`
+	Thumbnail string `json:"thumbnail,omitempty"`
+	Hls       string `json:"hls,omitempty"`
+	Dash      string `json:"dash,omitempty"`
+
+	// WebVTT track of the seek preview sprite sheet
+	Sprites string `json:"sprites,omitempty"`
+
+	// Incremented every time the video is re-edited or its thumbnail is
+	// replaced, the URLs of later versions contain it so cached files of
+	// earlier ones are not used
+	Version int `json:"version,omitempty"`
+
+	// Resized thumbnails by format and `srcset` width descriptor,
+	// eg. "webp" -> "320w" -> URL
+	Thumbnails map[string]map[string]string `json:"thumbnails,omitempty"`
+}
+
+// Progress of the transcoding in the current state
+type Progress struct {
+	Percent float64 `json:"percent"`
+	FPS     float64 `json:"fps"`
+
+	// Position of the transcoder in the video in seconds
+	Time float64 `json:"time"`
+}
+
+// Current status of a video, serialized as-is to the clients
+type Status struct {
+	Token   string    `json:"token"`
+	State   State     `json:"state"`
+	Error   string    `json:"error,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+
+	// Classification of the failure if known, eg. "unsupported-codec"
+	ErrorKind string `json:"errorKind,omitempty"`
+
+	// Only present while transcoding, never modified in place
+	Progress *Progress `json:"progress,omitempty"`
+
+	Outputs
+}
+
+// Kinds of status changes sent to subscribers
+const (
+	// The state of the video changed
+	EventPhase = "phase"
+
+	// The transcoding progressed
+	EventProgress = "progress"
+)
+
+// A change in the status of a video, see `Registry.Subscribe`
+type Event struct {
+	Type   string
+	Status Status
+}
+
+// Implemented by errors that know the kind of the failure, eg.
+// `transcode.TranscodeError`
+type classifiedError interface {
+	ErrorKind() string
+}
+
+// Returns the classification of `err`, empty if it's not classified
+func ErrorKind(err error) string {
+	if classified, ok := err.(classifiedError); ok {
+		return classified.ErrorKind()
+	}
+	return ""
+}
+
+// Number of events buffered per subscriber, events are dropped for
+// subscribers that don't keep up
+const subscriberBuffer = 16
+
+// Thread-safe collection of the statuses of videos indexed by their tokens
+type Registry struct {
+	mutex sync.Mutex
+	jobs  map[string]*Status
+
+	// Channels of the clients following the changes of a video
+	subscribers map[string][]chan Event
+
+	// How long to remember finished videos
+	retention time.Duration
+}
+
+func (self *Registry) lock() {
+	self.mutex.Lock()
+}
+
+func (self *Registry) unlock() {
+	self.mutex.Unlock()
+}
+
+// Create a new registry
+// retention: How long to keep statuses of finished videos around
+func NewRegistry(retention time.Duration) *Registry {
+	return &Registry{
+		mutex:       sync.Mutex{},
+		jobs:        make(map[string]*Status),
+		subscribers: make(map[string][]chan Event),
+		retention:   retention,
+	}
+}
+
+// Forget finished videos that are older than the retention time
+// Note: Needs to be called with the lock held
+func (self *Registry) unsafePrune(now time.Time) {
+	for token, status := range self.jobs {
+		if status.State.IsFinished() && now.Sub(status.Updated) > self.retention {
+			delete(self.jobs, token)
+			self.unsafeCloseSubscribers(token)
+		}
+	}
+}
+
+func (self *Registry) update(token string, state State, reason string, kind string) {
+	self.lock()
+	defer self.unlock()
+
+	now := time.Now()
+	self.unsafePrune(now)
+
+	status, ok := self.jobs[token]
+	if !ok {
+		status = &Status{
+			Token:   token,
+			Created: now,
+		}
+		self.jobs[token] = status
+	}
+
+	if status.State != state {
+		status.Progress = nil
+	}
+
+	status.State = state
+	status.Error = reason
+	status.ErrorKind = kind
+	status.Updated = now
+
+	self.unsafeNotify(token, EventPhase, status)
+}
+
+// Send an event to the subscribers of `token` without blocking
+// Note: Needs to be called with the lock held
+func (self *Registry) unsafeNotify(token string, eventType string, status *Status) {
+	for _, subscriber := range self.subscribers[token] {
+		select {
+		case subscriber <- Event{Type: eventType, Status: *status}:
+		default:
+		}
+	}
+}
+
+// Close the channels of the subscribers of `token`
+// Note: Needs to be called with the lock held
+func (self *Registry) unsafeCloseSubscribers(token string) {
+	for _, subscriber := range self.subscribers[token] {
+		close(subscriber)
+	}
+	delete(self.subscribers, token)
+}
+
+// Set the state of the video `token`, registers the video if it's not known
+func (self *Registry) Set(token string, state State) {
+	self.update(token, state, "", "")
+}
+
+// Mark the video `token` as failed because of `err`
+func (self *Registry) Fail(token string, err error) {
+	reason := "Unknown error"
+	if err != nil {
+		reason = err.Error()
+	}
+	self.update(token, StateFailed, reason, ErrorKind(err))
+}
+
+// Set the URLs of the video `token`, does nothing if the video is not known
+func (self *Registry) SetOutputs(token string, outputs Outputs) {
+	self.lock()
+	defer self.unlock()
+
+	status, ok := self.jobs[token]
+	if ok {
+		status.Outputs = outputs
+	}
+}
+
+// Set the transcoding progress of the video `token`, does nothing if the
+// video is not known
+func (self *Registry) SetProgress(token string, progress Progress) {
+	self.lock()
+	defer self.unlock()
+
+	status, ok := self.jobs[token]
+	if ok {
+		status.Progress = &progress
+		status.Updated = time.Now()
+		self.unsafeNotify(token, EventProgress, status)
+	}
+}
+
+// Follow the changes of the video `token`, returns a channel of events and a
+// function to stop following. The channel is closed if the video is removed.
+func (self *Registry) Subscribe(token string) (<-chan Event, func()) {
+	self.lock()
+	defer self.unlock()
+
+	subscriber := make(chan Event, subscriberBuffer)
+	self.subscribers[token] = append(self.subscribers[token], subscriber)
+
+	unsubscribe := func() {
+		self.lock()
+		defer self.unlock()
+
+		subscribers := self.subscribers[token]
+		for i, other := range subscribers {
+			if other == subscriber {
+				close(subscriber)
+				self.subscribers[token] = append(subscribers[:i:i], subscribers[i+1:]...)
+				break
+			}
+		}
+		if len(self.subscribers[token]) == 0 {
+			delete(self.subscribers, token)
+		}
+	}
+
+	return subscriber, unsubscribe
+}
+
+// Retrieve a copy of the status of the video `token`
+func (self *Registry) Get(token string) (Status, bool) {
+	self.lock()
+	defer self.unlock()
+
+	status, ok := self.jobs[token]
+	if !ok {
+		return Status{}, false
+	}
+	return *status, true
+}
+
+// Forget the video `token`, used when the video is deleted
+func (self *Registry) Remove(token string) {
+	self.lock()
+	defer self.unlock()
+
+	delete(self.jobs, token)
+	self.unsafeCloseSubscribers(token)
+}
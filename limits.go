@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"syscall"
+)
+
+// Admission control for uploads: a maximum upload size and a minimum amount
+// of free disk space, so a single upload can't fill the disk and break the
+// videos that are already being processed.
+
+// Maximum size of an uploaded video in bytes, zero means unlimited
+var maxUploadSize int64
+
+// Minimum free space to keep on the temp and serve filesystems in bytes
+var minFreeSpace int64 = 256 * 1024 * 1024
+
+var errUploadTooLarge = errors.New("Upload is too large")
+
+// Returns the number of bytes available to unprivileged users on the
+// filesystem containing `path`
+func freeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// Check that there is room for an upload of `length` bytes, 0 if not known.
+// Returns the HTTP status to respond with if there is not:
+// - 413 Request Entity Too Large if the upload is over `maxUploadSize`
+// - 507 Insufficient Storage if the temp filesystem is running out of space
+// - 503 Service Unavailable if the served files can't be stored
+func checkUploadAdmission(length int64) (int, error) {
+	if maxUploadSize > 0 && length > maxUploadSize {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("Upload is too large, the maximum is %d bytes", maxUploadSize)
+	}
+
+	if minFreeSpace <= 0 {
+		return http.StatusOK, nil
+	}
+
+	free, err := freeSpace(tempBase)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if free-length < minFreeSpace {
+		return http.StatusInsufficientStorage, errors.New("Not enough free disk space for the upload")
+	}
+
+	// The processed files are moved to the serve directory only when stored locally
+	if backend.Name() == "local" {
+		free, err := freeSpace(serveBase)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if free < minFreeSpace {
+			return http.StatusServiceUnavailable, errors.New("Not enough free disk space to store videos")
+		}
+	}
+
+	return http.StatusOK, nil
+}
+
+// Copy an upload from `src` to `dst` failing with `errUploadTooLarge` as soon
+// as more than `maxUploadSize` bytes are received
+func copyUpload(dst io.Writer, src io.Reader) (int64, error) {
+	if maxUploadSize <= 0 {
+		return io.Copy(dst, src)
+	}
+
+	// Read one extra byte to detect overflow
+	written, err := io.Copy(dst, io.LimitReader(src, maxUploadSize+1))
+	if written > maxUploadSize {
+		return written, errUploadTooLarge
+	}
+	return written, err
+}
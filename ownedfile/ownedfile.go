@@ -110,7 +110,7 @@ func (self *Collection) Create(path string, owner string) error {
 	return unsafeCreateOwner(path, owner)
 }
 
-// Move unowned file to an owned one
+// Move unowned file to an owned one, an existing file is replaced
 // Note: The owned file needs to be created first using `Create`
 func (self *Collection) Move(src string, path string, owner string) error {
 	self.lock()
@@ -121,22 +121,60 @@ func (self *Collection) Move(src string, path string, owner string) error {
 		return err
 	}
 
+	// Directories can't be renamed over each other, move the old one out of
+	// the way first and restore it if the new one can't be moved
+	info, err := os.Stat(path)
+	if err == nil && info.IsDir() {
+		oldPath := path + ".old"
+		_ = os.RemoveAll(oldPath)
+
+		err = os.Rename(path, oldPath)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(src, path)
+		if err != nil {
+			_ = os.Rename(oldPath, path)
+			return err
+		}
+
+		return os.RemoveAll(oldPath)
+	}
+
 	return os.Rename(src, path)
 }
 
+func unsafeDelete(path string) error {
+	// Remove the data file first and cancel deletion if it fails, _but_ the file
+	// not existing is not treated as an error, since ownerfiles can exist without
+	// data files. The data can also be a directory of files.
+	err := os.RemoveAll(path)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(getOwnerPath(path))
+}
+
 func (self *Collection) Delete(path string) error {
 	self.lock()
 	defer self.unlock()
 
-	// Remove the data file first and cancel deletion if it fails, _but_ the file
-	// not existing is not treated as an error, since ownerfiles can exist without
-	// data files.
-	err := os.Remove(path)
-	if err != nil && !os.IsNotExist(err) {
+	return unsafeDelete(path)
+}
+
+// Delete an owned file only if it's owned by `owner`
+func (self *Collection) DeleteOwned(path string, owner string) error {
+	self.lock()
+	defer self.unlock()
+
+	err := unsafeCheckOwner(path, owner)
+	if err != nil {
 		return err
 	}
 
-	return os.Remove(getOwnerPath(path))
+	return unsafeDelete(path)
 }
 
 func (self *Collection) ReadOwner(path string) (string, error) {
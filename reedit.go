@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"./jobstatus"
+	"./storage"
+
+	"github.com/gorilla/mux"
+)
+
+// Re-editing of processed videos. If enabled the source of a finished video is
+// kept in the temp directory with a manifest of its settings for a while, so
+// it can be processed again with new trimming or rotation without uploading it
+// again. The outputs of the new version are kept in the temp directory and
+// replace the served ones only when all of them are done.
+
+// How long to keep the sources of finished videos, zero disables re-editing
+var sourceRetention time.Duration
+
+// How often to look for expired sources
+const retentionPruneInterval = 1 * time.Hour
+
+// Keep the source of the successfully processed video for re-editing, the
+// manifest is written last and its modification time starts the retention
+func retainSource(video *videoToTranscode) {
+	if sourceRetention <= 0 {
+		return
+	}
+
+	// The source of a re-edit is already a link to the retained file
+	_ = os.Remove(video.keepPath)
+	err := os.Link(video.srcPath, video.keepPath)
+	if err != nil {
+		logError(err, video.keepPath, "Retain source")
+		return
+	}
+
+	err = writeManifestFile(video, jobstatus.StateDone, video.keepManifestPath)
+	if err != nil {
+		logError(err, video.keepManifestPath, "Write retained manifest")
+		_ = os.Remove(video.keepPath)
+	}
+}
+
+// Remove the retained source of the video `token` if there is one
+func discardRetainedSource(token string) {
+	for _, name := range []string{token + ".orig.json", token + ".orig.mp4"} {
+		err := os.Remove(path.Join(tempBase, name))
+		if err != nil && !os.IsNotExist(err) {
+			logError(err, name, "Delete retained source")
+		}
+	}
+}
+
+// Remove the retained sources whose retention time has passed
+func pruneRetainedSources() {
+	files, err := ioutil.ReadDir(tempBase)
+	if err != nil {
+		log.Printf("Failed to search retained sources: %s", err.Error())
+		return
+	}
+
+	now := time.Now()
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".orig.json") {
+			continue
+		}
+		if now.Sub(file.ModTime()) > sourceRetention {
+			token := strings.TrimSuffix(file.Name(), ".orig.json")
+			log.Printf("%s: Retention expired", token)
+			discardRetainedSource(token)
+		}
+	}
+}
+
+func pruneRetainedSourcesPeriodically() {
+	for {
+		pruneRetainedSources()
+		time.Sleep(retentionPruneInterval)
+	}
+}
+
+// Returns true if the video replaces the files of an earlier version
+func isReplacing(video *videoToTranscode) bool {
+	return video.version > 1
+}
+
+// Restore the versions of a video from its manifest, the previous version is
+// served until a re-edit is done
+func restoreVersion(video *videoToTranscode, manifest *videoManifest) {
+	if manifest.Version <= 1 {
+		return
+	}
+
+	video.version = manifest.Version
+	video.servedVersion = manifest.Version
+	if manifest.State != jobstatus.StateDone {
+		video.servedVersion--
+	}
+}
+
+// Name of the stored file with the served version of the video `token`, it
+// outlives the retained source and the job status
+func servedVersionName(token string) string {
+	return token + ".version.json"
+}
+
+// Contents of the file `servedVersionName`
+type servedVersionFile struct {
+	Version int `json:"version"`
+}
+
+// Store the served version of the video, written whenever it's incremented
+func storeServedVersion(video *videoToTranscode) error {
+	data, err := json.Marshal(servedVersionFile{Version: video.servedVersion})
+	if err != nil {
+		return err
+	}
+
+	name := servedVersionName(video.token)
+	tempPath := path.Join(tempBase, name)
+	err = ioutil.WriteFile(tempPath, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return backend.Put(tempPath, name, "application/json", video.owner)
+}
+
+// Returns the served version of the video `token` stored with
+// `storeServedVersion`, videos that were never re-edited have none stored
+func readServedVersion(token string) (int, error) {
+	data, err := backend.Read(servedVersionName(token))
+	if storage.IsNotExist(err) {
+		return 1, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var file servedVersionFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return 0, err
+	}
+	return file.Version, nil
+}
+
+// Load the settings of the retained source of the video `token`, the returned
+// video is at the served version. Returns the HTTP status to respond with if
+// the source is not retained or is owned by someone else than `user`, unless
+// the request is from an `admin`.
+func loadRetainedVideo(token string, user string, admin bool) (*videoToTranscode, int, error) {
+	manifest, err := readManifest(path.Join(tempBase, token+".orig.json"))
+	if err != nil {
+		return nil, http.StatusNotFound, errors.New("The original of the video is not available for editing")
+	}
+
+	if !admin && manifest.Owner != user {
+		return nil, http.StatusForbidden, errors.New("Video is owned by another user")
+	}
+
+	return videoFromManifest(token, manifest), http.StatusOK, nil
+}
+
+// Move the outputs of a re-edit from the temp directory to the storage, they
+// are kept there until all of them are done so a failed re-edit can't leave
+// the served files mixed from two versions. The video is moved last.
+func storeStagedOutputs(video *videoToTranscode) error {
+	if !video.customThumbnail {
+		err := storeThumbnail(video)
+		if err != nil {
+			return err
+		}
+	}
+
+	if video.hlsName != "" {
+		err := backend.PutDir(video.hlsDstPath, video.hlsName, video.owner)
+		if err != nil {
+			return err
+		}
+	}
+
+	if video.dashName != "" {
+		err := backend.PutDir(video.dashDstPath, video.dashName, video.owner)
+		if err != nil {
+			return err
+		}
+	}
+
+	if video.spriteName != "" {
+		err := putSprites(video)
+		if err != nil {
+			return err
+		}
+	}
+
+	return backend.Put(video.dstPath, video.videoName, "video/mp4", video.owner)
+}
+
+// Remove the outputs of a re-edit that were not moved to the storage
+func removeStagedOutputs(video *videoToTranscode) {
+	paths := []string{video.dstPath, video.thumbDstPath, video.spriteDstPath, video.spriteVttDstPath}
+	for _, variant := range thumbnailVariants(video) {
+		paths = append(paths, variant.Path)
+	}
+	for _, stagedPath := range paths {
+		if stagedPath == "" {
+			continue
+		}
+		err := os.Remove(stagedPath)
+		if err != nil && !os.IsNotExist(err) {
+			logError(err, stagedPath, "Delete staged output")
+		}
+	}
+
+	for _, stagedDir := range []string{video.hlsDstPath, video.dashDstPath} {
+		if stagedDir != "" {
+			_ = os.RemoveAll(stagedDir)
+		}
+	}
+}
+
+// Reserve the optional outputs that were enabled after the video was uploaded
+func reserveNewOutputs(video *videoToTranscode) error {
+	for _, name := range servedFileNames(video.token)[2:] {
+		_, err := backend.Owner(name)
+		if storage.IsNotExist(err) {
+			err = backend.Reserve(name, video.owner)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// > PATCH /uploads/:token
+// Processes the video again from its retained source with new `start` and
+// `end` or `edits`, see `parseEdits`, `rotate` and `thumbnail` query
+// parameters. The settings that are not given are kept. The served files are
+// replaced when the new version is done, until then the previous version is
+// served.
+func reeditHandler(w http.ResponseWriter, r *http.Request, user string, admin bool) (int, error) {
+
+	vars := mux.Vars(r)
+	token := vars["token"]
+
+	video, status, err := loadRetainedVideo(token, user, admin)
+	if err != nil {
+		return status, err
+	}
+
+	query := r.URL.Query()
+	if query.Get("start") != "" || query.Get("end") != "" || query.Get("edits") != "" {
+		video.trim.Ranges, err = parseEdits(query.Get("start"), query.Get("end"), query.Get("edits"))
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+
+	if query.Get("rotate") != "" {
+		video.rotate, err = parseRotate(query.Get("rotate"))
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+
+	// A new thumbnail time replaces a custom thumbnail
+	if query.Get("thumbnail") != "" {
+		video.thumbnailTime, err = parseThumbnailTime(query.Get("thumbnail"))
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		video.customThumbnail = false
+	}
+
+	video.version = video.servedVersion + 1
+
+	status, err = validateTrim(video, video.duration)
+	if err != nil {
+		return status, err
+	}
+
+	// A video can be processed only once at a time
+	if !activateIdleVideo(video) {
+		return http.StatusConflict, errors.New("The video is still being processed")
+	}
+
+	err = reserveNewOutputs(video)
+	if err == nil {
+		err = os.Link(video.keepPath, video.srcPath)
+	}
+	if err != nil {
+		deactivateVideo(video)
+		return http.StatusInternalServerError, err
+	}
+
+	setVideoState(video, jobstatus.StateQueued)
+	didAdd := fastProcessQueue.AddIfSpace(func() {
+		processVideoFast(video)
+	})
+
+	// The previous version is still served if the video can't be queued
+	if !didAdd {
+		log.Printf("%s: Process queue full: cancelling re-edit", video.srcPath)
+		removeVideoTempFiles(video)
+
+		video.version = video.servedVersion
+		setVideoStatus(video, jobstatus.StateDone)
+		return http.StatusServiceUnavailable, errors.New("Process queue full")
+	}
+
+	log.Printf("%s: Re-editing as version %d", video.srcPath, video.version)
+
+	jobStatus, _ := jobs.Get(token)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	err = json.NewEncoder(w).Encode(jobStatus)
+	if err != nil {
+		log.Printf("Failed to send response: %s", err.Error())
+	}
+
+	return http.StatusAccepted, nil
+}
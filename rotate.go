@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"./transcode"
+)
+
+// Manual rotation of uploaded videos. Phones that record sideways without
+// rotation metadata produce sideways videos, so the client can override the
+// detected rotation or add to it, and mirror the video.
+
+// Rotation requested by the client, see `parseRotate`
+type rotateSetting struct {
+
+	// Clockwise rotation in degrees
+	Degrees int
+
+	// `Degrees` is added to the detected rotation instead of replacing it
+	Relative bool
+
+	// Mirroring after the rotation
+	Flip transcode.Flip
+}
+
+// Names of the flips in the `rotate` parameter
+var flipNames = map[string]transcode.Flip{
+	"hflip": transcode.FlipHorizontal,
+	"vflip": transcode.FlipVertical,
+}
+
+// Parse the `rotate` parameter, nil if `rotateStr` is empty. The parameter is
+// a comma separated list of a rotation in clockwise degrees and a flip:
+// - `90`: Rotate 90 degrees ignoring the detected rotation
+// - `+90`, `-90`: Rotate 90 degrees more or less than the detected rotation
+// - `hflip`, `vflip`: Mirror the video horizontally or vertically
+// eg. "+180,hflip". Without a rotation the detected rotation is kept.
+func parseRotate(rotateStr string) (*rotateSetting, error) {
+	if rotateStr == "" {
+		return nil, nil
+	}
+
+	setting := &rotateSetting{Relative: true}
+	hasDegrees := false
+
+	for _, part := range strings.Split(rotateStr, ",") {
+		part = strings.TrimSpace(part)
+
+		if flip, ok := flipNames[part]; ok {
+			if setting.Flip != transcode.FlipNone {
+				return nil, errors.New("Rotation can have only one flip")
+			}
+			setting.Flip = flip
+			continue
+		}
+
+		degrees, err := strconv.Atoi(part)
+		if err != nil || hasDegrees {
+			return nil, errors.New("Rotation is malformed, expected degrees and optionally hflip or vflip")
+		}
+		hasDegrees = true
+
+		setting.Degrees = degrees % 360
+		setting.Relative = strings.HasPrefix(part, "+") || strings.HasPrefix(part, "-")
+	}
+
+	return setting, nil
+}
+
+// Formats the setting in the format of `parseRotate`
+func (setting *rotateSetting) String() string {
+	parts := []string{}
+
+	if setting.Relative && setting.Degrees >= 0 {
+		parts = append(parts, "+"+strconv.Itoa(setting.Degrees))
+	} else {
+		parts = append(parts, strconv.Itoa(setting.Degrees))
+	}
+
+	for name, flip := range flipNames {
+		if flip == setting.Flip {
+			parts = append(parts, name)
+		}
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// Returns the rotation to compensate for a video with `detected` rotation
+func (setting *rotateSetting) apply(detected int) int {
+	if setting.Relative {
+		return (detected + setting.Degrees + 360) % 360
+	}
+	return (setting.Degrees + 360) % 360
+}
+
+// Stored in the manifests in the format of `parseRotate` and parsed back with it
+func (setting *rotateSetting) MarshalJSON() ([]byte, error) {
+	return json.Marshal(setting.String())
+}
+
+func (setting *rotateSetting) UnmarshalJSON(data []byte) error {
+	var rotateStr string
+	err := json.Unmarshal(data, &rotateStr)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := parseRotate(rotateStr)
+	if err != nil {
+		return err
+	}
+	if parsed != nil {
+		*setting = *parsed
+	}
+	return nil
+}
+
+// Flip requested for the video, if any
+func videoFlip(video *videoToTranscode) transcode.Flip {
+	if video.rotate == nil {
+		return transcode.FlipNone
+	}
+	return video.rotate.Flip
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -15,16 +17,17 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"./jobstatus"
 	"./ownedfile"
+	"./storage"
 	"./transcode"
+	"./webhook"
 	"./workqueue"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/gorilla/mux"
 )
 
@@ -37,6 +40,9 @@ import _ "crypto/sha512"
 // A collection of owned files that contains the current files to be served
 var serveCollection *ownedfile.Collection = ownedfile.NewCollection()
 
+// Processing status of the videos, finished videos are forgotten after a day
+var jobs *jobstatus.Registry = jobstatus.NewRegistry(24 * time.Hour)
+
 // Work queues for transcoding, fast has more threads and transcodes into lower
 // quality, slow has fewer threads and only does high quality final transcodes.
 // Every video is passed first into the fast queue and when it has finished it's
@@ -60,80 +66,53 @@ var authUri string
 var storageUri string
 var apiUri string
 
-// AWS-related things
-var useAWS bool
-var bucketName string
-var bucketRegion string
-
-var s3Client *s3.S3
-var s3Uploader *s3manager.Uploader
-
-// Mutable global variables
-// ------------------------
-
-// Current requestID counter, used from many threads, use atomics!
-var requestID int32
-
-// AWS related functions
-// -----------------
-
-func getS3URL(fileName string) string {
-	return "https://" + bucketName + ".s3." + bucketRegion + ".amazonaws.com/" + fileName
-}
-
-func getThumbURL(fileName string) string {
-	return getS3URL("thumbs/" + fileName)
-}
-
-func getVideoURL(fileName string) string {
-	return getS3URL("videos/" + fileName)
-}
-
-func uploadToAWS(fileName string, key string, contentType string, metaData map[string]*string) (putOutput *s3manager.UploadOutput, err error) {
-	file, err := os.Open(fileName)
+// Storage where the processed videos and thumbnails are served from
+var backend storage.Backend
 
-	if err != nil {
-		return nil, err
-	}
+// Adaptive streaming outputs and the rendition ladder shared by them
+var useHLS bool
+var useDASH bool
+var renditions []transcode.Rendition
 
-	uploadResult, err := s3Uploader.Upload(&s3manager.UploadInput{
-		Bucket:      &bucketName,
-		ContentType: &contentType,
-		Metadata:    metaData,
-		Key:         &key,
-		Body:        file,
-	})
+// Seconds between the frames of the seek preview sprite sheets, disabled if
+// zero, and the layout of the sheets
+var spriteInterval float64
 
-	logError(err, key, "Upload to AWS")
-	return uploadResult, err
-}
+const spriteTileWidth = 160
+const spriteColumns = 10
 
-func getMetaFromAWS(key string) (output *s3.HeadObjectOutput, err error) {
+// Widths of the resized thumbnails generated in addition to the full size one
+// in every format of `thumbnailFormats`, none if empty
+var thumbnailWidths []int
 
-	headResult, err := s3Client.HeadObject(&s3.HeadObjectInput{
-		Bucket: &bucketName,
-		Key:    &key,
-	})
+// Formats of `transcode.ThumbnailFormats` the encoder can produce
+var thumbnailFormats []transcode.ImageFormat
 
-	return headResult, err
-}
+// Webhook endpoint that is notified of every video in addition to the
+// callbacks of the uploads, and the sender that signs and delivers the events
+var webhookUrl string
+var webhooks *webhook.Sender
 
-func deleteFromAWS(key string) (output *s3.DeleteObjectOutput, err error) {
+// Sender of the events to the callbacks of the uploads, the URLs are given by
+// the users so only public addresses are allowed
+var callbacks *webhook.Sender
 
-	deleteResult, err := s3Client.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: &bucketName,
-		Key:    &key,
-	})
+// Mutable global variables
+// ------------------------
 
-	logError(err, key, "Delete from AWS")
-	return deleteResult, err
-}
+// Current requestID counter, used from many threads, use atomics!
+var requestID int32
 
 // Utility functions
 // -----------------
 
 func logError(err error, context string, action string) {
-	if err != nil {
+	if transcodeErr, ok := err.(*transcode.TranscodeError); ok {
+		log.Printf("%s: %s failed (%s): %s", context, action, transcodeErr.Kind, transcodeErr.Error())
+		if transcodeErr.Stderr != "" {
+			log.Printf("%s: Transcoder output:\n%s", context, transcodeErr.Stderr)
+		}
+	} else if err != nil {
 		log.Printf("%s: %s failed: %s", context, action, err.Error())
 	} else {
 		log.Printf("%s: %s succeeded", context, action)
@@ -145,8 +124,9 @@ func logError(err error, context string, action string) {
 func authenticateFromMasterSecret(r *http.Request) (err error) {
 	authorization := r.Header.Get("Delete-Authorization")
 
-	if authorization != deleteSecret {
-		return errors.New(fmt.Sprintf("The delete secret %s was wrong!", authorization))
+	// Compare in constant time to not leak the secret through timing
+	if subtle.ConstantTimeCompare([]byte(authorization), []byte(deleteSecret)) != 1 {
+		return errors.New("The delete secret was wrong!")
 	} else {
 		return nil
 	}
@@ -194,7 +174,7 @@ func authenticateFromOIDC(r *http.Request) (user string, err error) {
 	// Find the user id from the subject
 	uid := data["sub"]
 	strid, ok := uid.(string)
-	if !ok {
+	if !ok || strid == "" {
 		return "", errors.New("OIDC did not return an user id")
 	}
 
@@ -216,145 +196,586 @@ func generateToken() (string, error) {
 // Video that is currently being transcoded
 type videoToTranscode struct {
 
-	// Local paths to temporary and to-be-served files
-	dlPath         string
-	srcPath        string
-	dstPath        string
-	servePath      string
-	thumbDstPath   string
-	thumbServePath string
-	token          string
-
-	cropEndTime   *int
-	cropStartTime *int
+	// Local paths to temporary files
+	dlPath       string
+	srcPath      string
+	dstPath      string
+	thumbDstPath string
+	hlsDstPath   string
+	dashDstPath  string
+	editPath     string
+	manifestPath string
+	token        string
+
+	// Local paths of the retained source and its manifest, see `reedit.go`
+	keepPath         string
+	keepManifestPath string
+
+	// Names of the served files in `backend`, optional outputs are empty if
+	// they are disabled
+	videoName string
+	thumbName string
+	hlsName   string
+	dashName  string
+
+	// Parts of the source to keep, if there are several they are concatenated
+	// into `editPath` which is transcoded instead of the source
+	trim transcode.TrimOptions
 
 	// URLs returned to the user
 	url       string
 	thumbUrl  string
+	hlsUrl    string
+	dashUrl   string
 	deleteUrl string
 
+	// Seek preview sprite sheet and its WebVTT track, empty if disabled
+	spriteDstPath    string
+	spriteVttDstPath string
+	spriteName       string
+	spriteVttName    string
+	spriteVttUrl     string
+
 	// User ID of the owner of this file
 	owner string
 
+	// Original file name of the upload, if any
+	title string
+
+	// URL to notify of the processing phases of this video, if any
+	callbackUrl string
+
+	// Total size of a resumable upload in bytes, see `tus.go`
+	uploadLength int64
+
 	// Rotation in degrees, filled in the fast processing phase
 	rotation int
-}
 
-// Create a new `videoToTranscode` struct
-func createVideoToTranscode(token string, serveVideoPath string, serveThumbPath string, cropStartTime *int, cropEndTime *int, user string) *videoToTranscode {
-	var thumbUrl string
-	var videoUrl string
+	// Rotation set by the client, overrides or adds to the detected rotation
+	rotate *rotateSetting
 
-	if useAWS {
-		thumbUrl = getThumbURL(token + ".jpg")
-		videoUrl = getVideoURL(token + ".mp4")
-	} else {
-		thumbUrl = fmt.Sprintf("%s/%s.jpg", storageUri, token)
-		videoUrl = fmt.Sprintf("%s/%s.mp4", storageUri, token)
+	// Time of the thumbnail relative to the edited video set by the client,
+	// the best looking frame is chosen if nil
+	thumbnailTime *float64
+
+	// The thumbnail was uploaded by the client and is not generated
+	customThumbnail bool
+
+	// Version of the files being produced, bumped every time the video is
+	// re-edited, and the version of the files currently served
+	version       int
+	servedVersion int
+
+	// Duration of the source in seconds, filled in the fast processing phase
+	duration float64
+
+	// Cancelled if the video is deleted while it's processed, see `cancel.go`
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Held by the worker while it processes the video, so cancelling can wait
+	// for the files being stored to be done
+	processing sync.Mutex
+}
+
+// Names of the files served for the video `token`, the video and the
+// thumbnail are always first followed by the enabled optional outputs
+func servedFileNames(token string) []string {
+	names := []string{token + ".mp4", token + ".jpg"}
+	if useHLS {
+		names = append(names, token+".hls")
+	}
+	if useDASH {
+		names = append(names, token+".dash")
+	}
+	if spriteInterval > 0.0 {
+		names = append(names, token+".sprites.jpg", token+".sprites.vtt")
 	}
+	names = append(names, servedVersionName(token))
+	return append(names, thumbnailVariantNames(token)...)
+}
+
+// Create a new `videoToTranscode` struct
+func createVideoToTranscode(token string, edits []transcode.TrimRange, user string) *videoToTranscode {
+	videoName := token + ".mp4"
+	thumbName := token + ".jpg"
 
-	return &videoToTranscode{
+	video := &videoToTranscode{
 		dlPath:    path.Join(tempBase, token+".dl.mp4"),
 		srcPath:   path.Join(tempBase, token+".src.mp4"),
 		dstPath:   path.Join(tempBase, token+".dst.mp4"),
-		servePath: serveVideoPath,
-		url:       videoUrl,
+		editPath:  path.Join(tempBase, token+".edit.mp4"),
+		videoName: videoName,
+		url:       backend.URL(videoName),
 		token:     token,
 
-		cropEndTime:   cropEndTime,
-		cropStartTime: cropStartTime,
+		trim: transcode.TrimOptions{Ranges: edits},
 
-		thumbDstPath:   path.Join(tempBase, token+".jpg"),
-		thumbServePath: serveThumbPath,
-		thumbUrl:       thumbUrl,
+		thumbDstPath: path.Join(tempBase, token+".jpg"),
+		thumbName:    thumbName,
+		thumbUrl:     backend.URL(thumbName),
+
+		manifestPath: path.Join(tempBase, token+".job.json"),
+
+		keepPath:         path.Join(tempBase, token+".orig.mp4"),
+		keepManifestPath: path.Join(tempBase, token+".orig.json"),
 
 		deleteUrl: fmt.Sprintf("%s/uploads/%s", apiUri, token),
 
 		owner: user,
+
+		version:       1,
+		servedVersion: 1,
+	}
+
+	video.ctx, video.cancel = context.WithCancel(context.Background())
+
+	if useHLS {
+		video.hlsName = token + ".hls"
+		video.hlsDstPath = path.Join(tempBase, token+".hls")
+		video.hlsUrl = backend.URL(video.hlsName + "/master.m3u8")
 	}
+
+	if useDASH {
+		video.dashName = token + ".dash"
+		video.dashDstPath = path.Join(tempBase, token+".dash")
+		video.dashUrl = backend.URL(video.dashName + "/manifest.mpd")
+	}
+
+	if spriteInterval > 0.0 {
+		video.spriteName = token + ".sprites.jpg"
+		video.spriteVttName = token + ".sprites.vtt"
+		video.spriteDstPath = path.Join(tempBase, video.spriteName)
+		video.spriteVttDstPath = path.Join(tempBase, video.spriteVttName)
+		video.spriteVttUrl = backend.URL(video.spriteVttName)
+	}
+
+	return video
 }
 
-// Just a wrapper for the `transcode` package:
-// - Generates the thumbnail from a relative time
-// - Moves the thumbnail to the destination when completed
-func generateThumbnail(video *videoToTranscode, relativeTime float64) error {
+// Persisted version of `videoToTranscode`, written next to the source file so
+// processing can be resumed after a restart, see `queuePendingVideosToTranscode`
+type videoManifest struct {
+	Token string `json:"token"`
+	Owner string `json:"owner"`
+	Title string `json:"title,omitempty"`
+
+	Callback string `json:"callback,omitempty"`
+
+	Edits []transcode.TrimRange `json:"edits,omitempty"`
+
+	Rotation int            `json:"rotation"`
+	Rotate   *rotateSetting `json:"rotate,omitempty"`
+	Duration float64        `json:"duration,omitempty"`
+
+	// Thumbnail settings, see `videoToTranscode.thumbnailTime`
+	ThumbnailTime   *float64 `json:"thumbnailTime,omitempty"`
+	CustomThumbnail bool     `json:"customThumbnail,omitempty"`
+
+	// Version of the files being produced, see `videoToTranscode.version`
+	Version int `json:"version,omitempty"`
 
-	// Extract the duration
-	duration, err := transcode.ExtractDuration(video.srcPath)
+	// Total size of a resumable upload in bytes
+	UploadLength int64 `json:"uploadLength,omitempty"`
+
+	// Last processing phase that was reached
+	State jobstatus.State `json:"state"`
+
+	// Name of the storage backend the video is served from
+	Storage string `json:"storage"`
+}
+
+// Write the manifest of the video atomically
+func writeManifest(video *videoToTranscode, state jobstatus.State) error {
+	return writeManifestFile(video, state, video.manifestPath)
+}
+
+// Write the manifest of the video atomically to `manifestPath`
+func writeManifestFile(video *videoToTranscode, state jobstatus.State, manifestPath string) error {
+	manifest := videoManifest{
+		Token:        video.token,
+		Owner:        video.owner,
+		Title:        video.title,
+		Callback:     video.callbackUrl,
+		Edits:        video.trim.Ranges,
+		Rotation:     video.rotation,
+		Rotate:       video.rotate,
+		Duration:     video.duration,
+		Version:      video.version,
+		UploadLength: video.uploadLength,
+		State:        state,
+		Storage:      backend.Name(),
+
+		ThumbnailTime:   video.thumbnailTime,
+		CustomThumbnail: video.customThumbnail,
+	}
+
+	data, err := json.Marshal(manifest)
 	if err != nil {
 		return err
 	}
 
-	// Generate the thumbnail
-	time := duration * relativeTime
-	options := transcode.Options{
-		CompensateRotation: video.rotation,
-		Quality:            transcode.QualityHigh,
+	// Write to a temporary file first so a crash never leaves a partial manifest
+	tempPath := manifestPath + ".tmp"
+	err = ioutil.WriteFile(tempPath, data, 0644)
+	if err != nil {
+		return err
 	}
-	err = transcode.GenerateThumbnail(video.srcPath, video.thumbDstPath, time, &options)
+
+	err = os.Rename(tempPath, manifestPath)
 	if err != nil {
+		_ = os.Remove(tempPath)
 		return err
 	}
 
-	// Move the generated thumbnail to the serve path
-	if useAWS {
-		metaMap := make(map[string]*string)
-		metaMap["owner"] = &video.token
-		_, err := uploadToAWS(video.thumbDstPath, "thumbs/"+video.token+".jpg", "image/jpeg", metaMap)
+	return nil
+}
 
-		if err != nil {
-			return err
+// Read a manifest written by `writeManifest`
+func readManifest(manifestPath string) (*videoManifest, error) {
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest videoManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
+
+// Create a `videoToTranscode` of the video `token` with the settings and the
+// versions of its manifest
+func videoFromManifest(token string, manifest *videoManifest) *videoToTranscode {
+	video := createVideoToTranscode(token, manifest.Edits, manifest.Owner)
+	video.title = manifest.Title
+	video.callbackUrl = manifest.Callback
+	video.rotation = manifest.Rotation
+	video.rotate = manifest.Rotate
+	video.duration = manifest.Duration
+	video.thumbnailTime = manifest.ThumbnailTime
+	video.customThumbnail = manifest.CustomThumbnail
+	restoreVersion(video, manifest)
+	return video
+}
+
+// Returns `url` of the file in `version`, later versions have the version in
+// the query so caches don't serve the files of earlier ones
+func versionedUrl(url string, version int) string {
+	if url == "" || version <= 1 {
+		return url
+	}
+	return fmt.Sprintf("%s?v=%d", url, version)
+}
+
+// URLs of the served version of the video for the job status
+func videoOutputs(video *videoToTranscode) jobstatus.Outputs {
+	return jobstatus.Outputs{
+		Video:     versionedUrl(video.url, video.servedVersion),
+		Thumbnail: versionedUrl(video.thumbUrl, video.servedVersion),
+		Hls:       versionedUrl(video.hlsUrl, video.servedVersion),
+		Dash:      versionedUrl(video.dashUrl, video.servedVersion),
+		Sprites:   versionedUrl(video.spriteVttUrl, video.servedVersion),
+		Version:   video.servedVersion,
+
+		Thumbnails: thumbnailUrls(video.token, video.servedVersion),
+	}
+}
+
+// Update the processing state of the video in the job status
+func setVideoStatus(video *videoToTranscode, state jobstatus.State) {
+	jobs.Set(video.token, state)
+	jobs.SetOutputs(video.token, videoOutputs(video))
+}
+
+// Update the processing state of the video and persist it to the manifest
+func setVideoState(video *videoToTranscode, state jobstatus.State) {
+	setVideoStatus(video, state)
+
+	err := writeManifest(video, state)
+	if err != nil {
+		logError(err, video.manifestPath, "Write manifest")
+	}
+}
+
+// Send a webhook event of the video reaching `state` to the callback of the
+// upload and the server-wide webhook, `reason` is the error if failed
+func notifyVideo(video *videoToTranscode, state jobstatus.State, reason error) {
+	event := webhook.Event{
+		Token:    video.token,
+		Owner:    video.owner,
+		Phase:    state,
+		Duration: video.duration,
+		Time:     time.Now(),
+		Outputs:  videoOutputs(video),
+	}
+	if reason != nil {
+		event.Error = reason.Error()
+		event.ErrorKind = jobstatus.ErrorKind(reason)
+	}
+
+	if video.callbackUrl != "" {
+		callbacks.Send(video.callbackUrl, event)
+	}
+	if webhookUrl != "" && webhookUrl != video.callbackUrl {
+		webhooks.Send(webhookUrl, event)
+	}
+}
+
+// Mark the video as failed in the job status and the manifest and notify the
+// webhooks
+func failVideo(video *videoToTranscode, err error) {
+	jobs.Fail(video.token, err)
+
+	manifestErr := writeManifest(video, jobstatus.StateFailed)
+	if manifestErr != nil {
+		logError(manifestErr, video.manifestPath, "Write manifest")
+	}
+
+	notifyVideo(video, jobstatus.StateFailed, err)
+}
+
+// Remove the temporary files that are kept for the whole processing, this is
+// the last step of processing a video
+func removeVideoTempFiles(video *videoToTranscode) {
+	deactivateVideo(video)
+
+	err := os.Remove(video.srcPath)
+	logError(err, video.srcPath, "Delete source file")
+
+	err = os.Remove(video.manifestPath)
+	logError(err, video.manifestPath, "Delete manifest")
+
+	if isEdited(video) {
+		err = os.Remove(video.editPath)
+		if err != nil && !os.IsNotExist(err) {
+			logError(err, video.editPath, "Delete edited file")
 		}
+	}
+
+	if isReplacing(video) {
+		removeStagedOutputs(video)
+	}
+}
+
+// Returns true if the video is concatenated from several ranges
+func isEdited(video *videoToTranscode) bool {
+	return len(video.trim.Ranges) > 1
+}
 
+// Returns the file to transcode with the options to compensate its rotation
+// and its duration for the progress, and the trimming: the concatenated edit
+// if the video has several ranges, otherwise the source
+func transcodeSource(video *videoToTranscode) (string, transcode.Options, *transcode.TrimOptions) {
+	if isEdited(video) {
+		// The concatenated edit is only as long as the ranges
+		options := transcode.Options{
+			Duration: video.trim.Duration(video.duration),
+		}
+		return video.editPath, options, nil
+	}
+	options := transcode.Options{
+		CompensateRotation: video.rotation,
+		Flip:               videoFlip(video),
+		Duration:           video.duration,
+	}
+	return video.srcPath, options, &video.trim
+}
+
+// Just a wrapper for the `transcode` package:
+// - Concatenates the ranges of the edit list into a single video that the
+//   rest of the processing uses as the source
+func editVideo(video *videoToTranscode) error {
+	options := transcode.Options{
+		CompensateRotation: video.rotation,
+		Flip:               videoFlip(video),
+		Quality:            transcode.QualityHigh,
+	}
+	ctx, cancel := transcodeContext(video, 1)
+	defer cancel()
+
+	err := transcode.EditContext(ctx, video.srcPath, video.editPath, &video.trim, &options)
+	return transcodeTimeoutError(err)
+}
+
+// Number of frames to choose the thumbnail from, they are spread evenly over
+// the middle of the video since the start and the end are often fades
+const thumbnailCandidates = 5
+const thumbnailSampleStart = 0.1
+const thumbnailSampleEnd = 0.9
+
+// Just a wrapper for the `transcode` package:
+// - Generates the thumbnail from the best looking candidate frame, or from
+//   `video.thumbnailTime` relative to the edited video if set
+// - Moves the thumbnail to the destination when completed
+func generateThumbnail(video *videoToTranscode) error {
+
+	// Generate the thumbnail
+	src, options, trimOptions := transcodeSource(video)
+	duration := video.trim.Duration(video.duration)
+	options.Quality = transcode.QualityHigh
+	ctx, cancel := transcodeContext(video, 0)
+	defer cancel()
+
+	var err error
+	if video.thumbnailTime != nil || duration <= 0.0 {
+		relativeTime := 0.0
+		if video.thumbnailTime != nil {
+			relativeTime = *video.thumbnailTime
+		}
+		time := trimOptions.SourceTime(duration*relativeTime, video.duration)
+		err = transcode.GenerateThumbnailContext(ctx, src, video.thumbDstPath, time, &options)
 	} else {
-		err = serveCollection.Move(video.thumbDstPath, video.thumbServePath, video.owner)
-		if err != nil {
-			_ = os.Remove(video.thumbDstPath)
-			return err
+		times := []float64{}
+		for i := 0; i < thumbnailCandidates; i++ {
+			relativeTime := thumbnailSampleStart + (thumbnailSampleEnd-thumbnailSampleStart)*float64(i)/float64(thumbnailCandidates-1)
+			times = append(times, trimOptions.SourceTime(duration*relativeTime, video.duration))
+		}
+
+		var time float64
+		time, err = transcode.GenerateBestThumbnailContext(ctx, src, video.thumbDstPath, times, &options)
+		if err == nil {
+			log.Printf("%s: Chose thumbnail at %.2f seconds", video.srcPath, time)
 		}
 	}
+	if err != nil {
+		return transcodeTimeoutError(err)
+	}
 
-	return nil
+	// Don't resurrect the files of a deleted video
+	if video.ctx.Err() != nil {
+		return video.ctx.Err()
+	}
+
+	// Resize and move the generated thumbnail to the storage, a re-edit keeps
+	// it in the temp directory until all of its outputs are done
+	if isReplacing(video) {
+		err = resizeThumbnail(ctx, video)
+	} else {
+		err = putThumbnail(ctx, video)
+	}
+	return transcodeTimeoutError(err)
 }
 
 // Just a wrapper for the `transcode` package:
 // - Moves the video to the destination when completed
 func transcodeVideo(video *videoToTranscode, quality transcode.Quality) error {
-	// Do the transcoding itself
-	options := transcode.Options{
-		CompensateRotation: video.rotation,
-		Quality:            quality,
+	// Do the transcoding itself, the progress is shown in the job status
+	src, options, trimOptions := transcodeSource(video)
+	options.Quality = quality
+	options.OnProgress = func(progress transcode.Progress) {
+		jobs.SetProgress(video.token, jobstatus.Progress{
+			Percent: progress.Percent,
+			FPS:     progress.FPS,
+			Time:    progress.Time,
+		})
+	}
+
+	ctx, cancel := transcodeContext(video, 1)
+	defer cancel()
+
+	err := transcode.TranscodeMP4Context(ctx, src, video.dstPath, &options, trimOptions)
+	if err != nil {
+		return transcodeTimeoutError(err)
 	}
 
-	trimOptions := transcode.TrimOptions{
-		Start: video.cropStartTime,
-		End:   video.cropEndTime,
+	// Don't resurrect the files of a deleted video
+	if video.ctx.Err() != nil {
+		return video.ctx.Err()
 	}
 
-	err := transcode.TranscodeMP4(video.srcPath, video.dstPath, &options, &trimOptions)
+	// A re-edit is moved to the storage with its other outputs
+	if isReplacing(video) {
+		return nil
+	}
+
+	// Move the transcoded video to the storage
+	return backend.Put(video.dstPath, video.videoName, "video/mp4", video.owner)
+}
+
+// Signature shared by `transcode.TranscodeHLSContext` and `transcode.TranscodeDASHContext`
+type streamingTranscodeFunc func(context.Context, string, string, []transcode.Rendition, *transcode.Options, *transcode.TrimOptions) error
+
+// Just a wrapper for the `transcode` package:
+// - Transcodes the adaptive streaming renditions into a temporary directory
+// - Moves the directory to the destination when completed
+func transcodeStreaming(video *videoToTranscode, transcodeFunc streamingTranscodeFunc, dstDir string, name string) error {
+	src, options, trimOptions := transcodeSource(video)
+
+	// Remove leftovers from an interrupted transcode
+	_ = os.RemoveAll(dstDir)
+
+	// Every rendition is a separate encoding pass
+	ctx, cancel := transcodeContext(video, len(renditions))
+	defer cancel()
+
+	err := transcodeFunc(ctx, src, dstDir, renditions, &options, trimOptions)
 	if err != nil {
-		return err
+		_ = os.RemoveAll(dstDir)
+		return transcodeTimeoutError(err)
 	}
 
-	// Move the transcoded video to the serving path
-	if useAWS {
-		metaMap := make(map[string]*string)
-		metaMap["owner"] = &video.token
-		_, err := uploadToAWS(string(video.dstPath), "videos/"+video.token+".mp4", "video/mp4", metaMap)
-		if err != nil {
-			return err
-		}
+	// Don't resurrect the files of a deleted video
+	if video.ctx.Err() != nil {
+		_ = os.RemoveAll(dstDir)
+		return video.ctx.Err()
+	}
 
-	} else {
+	// A re-edit is moved to the storage with its other outputs
+	if isReplacing(video) {
+		return nil
+	}
 
-		err = serveCollection.Move(video.dstPath, video.servePath, video.owner)
-		if err != nil {
-			_ = os.Remove(video.dstPath)
-			return err
-		}
+	return backend.PutDir(dstDir, name, video.owner)
+}
+
+// Just a wrapper for the `transcode` package:
+// - Generates the seek preview sprite sheet and its WebVTT track
+// - Moves them to the destination when completed
+func generateSprites(video *videoToTranscode) error {
+	src, options, trimOptions := transcodeSource(video)
+	spriteOptions := transcode.SpriteOptions{
+		Interval: spriteInterval,
+		Width:    spriteTileWidth,
+		Columns:  spriteColumns,
+
+		// The storage may keep the track and the sheet under different paths
+		ImageUrl: versionedUrl(backend.URL(video.spriteName), video.version),
+	}
+	ctx, cancel := transcodeContext(video, 1)
+	defer cancel()
+
+	err := transcode.GenerateSpritesContext(ctx, src, video.spriteDstPath, video.spriteVttDstPath,
+		video.trim.Duration(video.duration), &spriteOptions, &options, trimOptions)
+	if err == nil && video.ctx.Err() != nil {
+		// Don't resurrect the files of a deleted video
+		err = video.ctx.Err()
+	}
+	if err != nil {
+		_ = os.Remove(video.spriteDstPath)
+		_ = os.Remove(video.spriteVttDstPath)
+		return transcodeTimeoutError(err)
 	}
 
-	return nil
+	// A re-edit is moved to the storage with its other outputs
+	if isReplacing(video) {
+		return nil
+	}
+	return putSprites(video)
+}
+
+// Move the generated sprite sheet and its WebVTT track to the storage
+func putSprites(video *videoToTranscode) error {
+	// The sheet first so the track never refers to a missing one
+	err := backend.Put(video.spriteDstPath, video.spriteName, "image/jpeg", video.owner)
+	if err != nil {
+		_ = os.Remove(video.spriteVttDstPath)
+		return err
+	}
+	return backend.Put(video.spriteVttDstPath, video.spriteVttName, "text/vtt", video.owner)
 }
 
 // Background worker proceses
@@ -365,21 +786,65 @@ func transcodeVideo(video *videoToTranscode, quality transcode.Quality) error {
 // - Generate thumbnail
 // - Transcode a low quality version
 func processVideoFast(video *videoToTranscode) {
+	video.processing.Lock()
+	defer video.processing.Unlock()
 
-	// Extract the rotation from the metadata
-	rotation, err := transcode.ExtractRotation(video.srcPath)
-	logError(err, video.srcPath, "Extract rotation")
+	// The video may have been deleted while queued
+	if isVideoCancelled(video) {
+		removeVideoTempFiles(video)
+		return
+	}
+
+	setVideoState(video, jobstatus.StateFastTranscoding)
+	notifyVideo(video, jobstatus.StateFastTranscoding, nil)
+
+	// Read the rotation and duration from the metadata
+	info, err := transcode.Inspect(video.srcPath)
+	logError(err, video.srcPath, "Inspect")
 	if err == nil {
-		video.rotation = rotation
+		video.rotation = info.Rotation()
+		video.duration = info.Duration
+	}
+	if video.rotate != nil {
+		video.rotation = video.rotate.apply(video.rotation)
 	}
 
-	// Generate a thumbnail for the video
-	err = generateThumbnail(video, 0.3)
-	logError(err, video.srcPath, "Generate thumbnail")
+	// Concatenate the ranges of the edit list once for all the outputs, the
+	// video can still be transcoded without the metadata
+	err = nil
+	if isEdited(video) {
+		err = editVideo(video)
+		logError(err, video.srcPath, "Edit")
+	}
+
+	if err == nil {
+		// Generate a thumbnail for the video unless the client uploaded one
+		if !video.customThumbnail {
+			err = generateThumbnail(video)
+			logError(err, video.srcPath, "Generate thumbnail")
+		}
 
-	// Transcode a quick, low quality version to make the service responsive
-	err = transcodeVideo(video, transcode.QualityLow)
-	logError(err, video.srcPath, "Transcode low-quality")
+		// Transcode a quick, low quality version to make the service responsive,
+		// a re-edited video keeps serving the previous version instead
+		if !isReplacing(video) {
+			err = transcodeVideo(video, transcode.QualityLow)
+			logError(err, video.srcPath, "Transcode low-quality")
+		}
+	}
+
+	// If even the low quality version can't be produced there is no point in
+	// trying the high quality one, a deleted video has no status to update
+	if err != nil {
+		if !isVideoCancelled(video) {
+			failVideo(video, err)
+		}
+		removeVideoTempFiles(video)
+		return
+	}
+
+	// Persist the metadata so the slow pass can be resumed directly
+	setVideoState(video, jobstatus.StateLowQualityReady)
+	notifyVideo(video, jobstatus.StateLowQualityReady, nil)
 
 	// Queue the full quality transcoding
 	slowProcessQueue.AddBlocking(func() {
@@ -391,14 +856,65 @@ func processVideoFast(video *videoToTranscode) {
 // - Transcode a high quality version
 // - Delete the temporary files
 func processVideoSlow(video *videoToTranscode) {
+	video.processing.Lock()
+	defer video.processing.Unlock()
+
+	// The video may have been deleted while queued
+	if isVideoCancelled(video) {
+		removeVideoTempFiles(video)
+		return
+	}
+
+	setVideoState(video, jobstatus.StateSlowTranscoding)
+	notifyVideo(video, jobstatus.StateSlowTranscoding, nil)
 
 	// Transcode a better quality version of the video
 	err := transcodeVideo(video, transcode.QualityHigh)
 	logError(err, video.srcPath, "Transcode high-quality")
 
+	// Transcode the adaptive streaming renditions
+	if err == nil && video.hlsName != "" {
+		err = transcodeStreaming(video, transcode.TranscodeHLSContext, video.hlsDstPath, video.hlsName)
+		logError(err, video.srcPath, "Transcode HLS")
+	}
+
+	if err == nil && video.dashName != "" {
+		err = transcodeStreaming(video, transcode.TranscodeDASHContext, video.dashDstPath, video.dashName)
+		logError(err, video.srcPath, "Transcode DASH")
+	}
+
+	if err == nil && video.spriteName != "" {
+		err = generateSprites(video)
+		logError(err, video.srcPath, "Generate sprites")
+	}
+
+	// Replace the served files of the previous version only now that all the
+	// outputs of the re-edit are done
+	if err == nil && isReplacing(video) && !isVideoCancelled(video) {
+		err = storeStagedOutputs(video)
+		logError(err, video.srcPath, "Store re-edit")
+	}
+
+	if isVideoCancelled(video) {
+		log.Printf("%s: Processing cancelled", video.srcPath)
+	} else if err != nil {
+		failVideo(video, err)
+	} else {
+		video.servedVersion = video.version
+		if isReplacing(video) {
+			err = storeServedVersion(video)
+			logError(err, video.srcPath, "Store served version")
+		}
+
+		setVideoState(video, jobstatus.StateDone)
+		notifyVideo(video, jobstatus.StateDone, nil)
+
+		// Keep the source around for re-editing if enabled
+		retainSource(video)
+	}
+
 	// Remove the source file as it's not needed anymore
-	err = os.Remove(video.srcPath)
-	logError(err, video.srcPath, "Delete source file")
+	removeVideoTempFiles(video)
 }
 
 // HTTP handlers
@@ -439,18 +955,29 @@ func wrappedHandler(inner func(http.ResponseWriter, *http.Request) (int, error))
 }
 
 // Wraps a handler function and adds support for:
-// - Authenticating the request from the master secret (Used for deletion)
+// - Authenticating the request from the master secret if it's present
+// - Otherwise authentication using OIDC
+// - Passes the user ID to the wrapped func, or an empty ID and `admin` for the
+//   master secret which may access the videos of every user
 // - Never calls the inner handler if authentication failed
-func authenticateSecretHandler(inner func(http.ResponseWriter, *http.Request) (int, error)) func(http.ResponseWriter, *http.Request) (int, error) {
+func authenticateSecretOrOIDCHandler(inner func(http.ResponseWriter, *http.Request, string, bool) (int, error)) func(http.ResponseWriter, *http.Request) (int, error) {
 	return func(w http.ResponseWriter, r *http.Request) (int, error) {
 
-		// Authenticate
-		err := authenticateFromMasterSecret(r)
+		if r.Header.Get("Delete-Authorization") != "" {
+			err := authenticateFromMasterSecret(r)
+			if err != nil {
+				return http.StatusUnauthorized, err
+			}
+
+			return inner(w, r, "", true)
+		}
+
+		user, err := authenticateFromOIDC(r)
 		if err != nil {
 			return http.StatusUnauthorized, err
 		}
 
-		return inner(w, r)
+		return inner(w, r, user, false)
 	}
 }
 
@@ -482,76 +1009,302 @@ func optionsHandler(methods ...string) func(http.ResponseWriter, *http.Request)
 	}
 }
 
-// > POST /uploads
-// Uploads a new video to be transcoded and returns the URLs where the video
-// will be hosted.
-// Supports both raw data body and multipart form files.
-func uploadHandler(w http.ResponseWriter, r *http.Request, user string) (int, error) {
+// Parse a single trim time in milliseconds, nil if `timeStr` is empty
+func parseTrimTime(timeStr string) (*int, error) {
+	if timeStr == "" {
+		return nil, nil
+	}
 
-	var video *videoToTranscode
+	time, err := strconv.Atoi(timeStr)
+	if err != nil || time < 0 {
+		return nil, errors.New("Trim start or end were malformed!")
+	}
 
-	var startTrimPointer *int
-	var endTrimPointer *int
+	return &time, nil
+}
 
-	startTimeStr := r.URL.Query().Get("start")
-	endTimeStr := r.URL.Query().Get("end")
+// Parse the parts of the video to keep, either a JSON edit list
+// `[{"start": 0, "end": 1500}, {"start": 4000}]` or a single range from the
+// trim times. The times are in milliseconds and may be missing from the start
+// of the first range and the end of the last one. Returns nil if untrimmed.
+func parseEdits(startTimeStr string, endTimeStr string, editsStr string) ([]transcode.TrimRange, error) {
+	var edits []transcode.TrimRange
 
-	if startTimeStr != "" && endTimeStr != "" {
-		startTime, startErr := strconv.Atoi(startTimeStr)
-		endTime, endErr := strconv.Atoi(endTimeStr)
+	if editsStr != "" {
+		if startTimeStr != "" || endTimeStr != "" {
+			return nil, errors.New("Use either an edit list or trim start and end")
+		}
 
-		if startErr == nil && endErr == nil {
-			startTrimPointer = &startTime
-			endTrimPointer = &endTime
-		} else {
-			return http.StatusBadRequest, errors.New("Trim start or end were malformed!")
+		err := json.Unmarshal([]byte(editsStr), &edits)
+		if err != nil {
+			return nil, errors.New("Edit list is malformed, expected a JSON array of {\"start\", \"end\"}")
+		}
+		if len(edits) == 0 {
+			return nil, errors.New("Edit list is empty")
+		}
+	} else {
+		startTime, err := parseTrimTime(startTimeStr)
+		if err != nil {
+			return nil, err
+		}
+
+		endTime, err := parseTrimTime(endTimeStr)
+		if err != nil {
+			return nil, err
 		}
 
-		if endTime < startTime {
-			return http.StatusBadRequest, errors.New("Trim end cannot be shorter than trim start")
+		if startTime == nil && endTime == nil {
+			return nil, nil
 		}
+		edits = []transcode.TrimRange{{Start: startTime, End: endTime}}
 	}
 
-	// Generate an unique token and assign the file to the current user
+	// The ranges must be in order and not overlap
+	previousEnd := -1
+	for i, edit := range edits {
+		if (edit.Start != nil && *edit.Start < 0) || (edit.End != nil && *edit.End < 0) {
+			return nil, errors.New("Trim times cannot be negative")
+		}
+		if i > 0 && edit.Start == nil {
+			return nil, errors.New("Only the first range can be without a start")
+		}
+		if i < len(edits)-1 && edit.End == nil {
+			return nil, errors.New("Only the last range can be without an end")
+		}
+		if edit.Start != nil && *edit.Start < previousEnd {
+			return nil, errors.New("Ranges must be in order and not overlap")
+		}
+		if edit.Start != nil && edit.End != nil && *edit.End <= *edit.Start {
+			return nil, errors.New("Trim end must be after trim start")
+		}
+		if edit.End != nil {
+			previousEnd = *edit.End
+		}
+	}
+
+	return edits, nil
+}
+
+// Parse the time of the thumbnail relative to the length of the video, nil if
+// `timeStr` is empty
+func parseThumbnailTime(timeStr string) (*float64, error) {
+	if timeStr == "" {
+		return nil, nil
+	}
+
+	time, err := strconv.ParseFloat(timeStr, 64)
+	if err != nil || time < 0.0 || time > 1.0 {
+		return nil, errors.New("Thumbnail time must be a number from 0 to 1")
+	}
+
+	return &time, nil
+}
+
+// Parse the callback URL of an upload, only absolute HTTP(S) URLs are allowed
+func parseCallbackUrl(callback string) (string, error) {
+	if callback == "" {
+		return "", nil
+	}
+
+	callbackUrl, err := url.Parse(callback)
+	if err != nil || (callbackUrl.Scheme != "http" && callbackUrl.Scheme != "https") || callbackUrl.Host == "" {
+		return "", errors.New("Callback must be an absolute http or https URL")
+	}
+
+	return callbackUrl.String(), nil
+}
+
+// Generate an unique token for a new video and reserve the served files for `user`
+func reserveVideo(edits []transcode.TrimRange, user string) (*videoToTranscode, error) {
 	for try := 0; try < 10; try++ {
 		token, err := generateToken()
 		if err != nil {
-			return http.StatusInternalServerError, err
+			return nil, err
 		}
 
-		var serveVideoPath string
-		var serveThumbPath string
-
-		if useAWS {
-			serveVideoPath = path.Join(serveBase, token+".mp4")
-			serveThumbPath = path.Join(serveBase, token+".jpg")
+		video := createVideoToTranscode(token, edits, user)
 
-			// Reserve the owner for the destination files
-			err = serveCollection.Create(serveVideoPath, user)
+		// Reserve the owner for the destination files, if any of the names is
+		// taken release the ones reserved so far and try another token
+		names := servedFileNames(token)
+		reserved := 0
+		for _, name := range names {
+			err = backend.Reserve(name, user)
 			if err != nil {
-				log.Printf("Failed to create video: %s", err)
-				continue
+				log.Printf("Failed to create %s: %s", name, err)
+				break
 			}
-			err = serveCollection.Create(serveThumbPath, user)
-			if err != nil {
-				log.Printf("Failed to create thumbnail: %s", err)
-				err := serveCollection.Delete(serveVideoPath)
+			reserved++
+		}
+
+		if reserved < len(names) {
+			for _, name := range names[:reserved] {
+				err := backend.Delete(name, user)
 				if err != nil {
-					log.Printf("Failed to remove video: %s", err)
+					log.Printf("Failed to remove %s: %s", name, err)
 				}
-				continue
 			}
+			continue
 		}
 
-		video = createVideoToTranscode(token, serveVideoPath, serveThumbPath, startTrimPointer, endTrimPointer, user)
-		break
+		log.Printf("%s: Created owned file", video.srcPath)
+		return video, nil
 	}
 
-	if video == nil {
-		return http.StatusInternalServerError, errors.New("Could not create unique name")
+	return nil, errors.New("Could not create unique name")
+}
+
+// Release the served files reserved in `reserveVideo`
+func releaseVideo(video *videoToTranscode) {
+	for _, name := range servedFileNames(video.token) {
+		err := backend.Delete(name, video.owner)
+		logError(err, video.srcPath, "Delete serve file "+name)
 	}
+}
+
+// Remove the partial download of a video that won't be processed and release
+// its served files
+func discardUpload(video *videoToTranscode) {
+	err := os.Remove(video.dlPath)
+	if err != nil && !os.IsNotExist(err) {
+		logError(err, video.dlPath, "Delete download file")
+	}
+	_ = os.Remove(video.manifestPath)
+	releaseVideo(video)
+}
+
+// Move the completely downloaded video to be the source file and queue it for
+// processing. If the video is invalid or can't be queued all of its files are
+// removed.
+func queueDownloadedVideo(video *videoToTranscode) (int, error) {
+	log.Printf("%s: Downloaded video data", video.srcPath)
+
+	status, err := validateDownloadedVideo(video)
+	if err != nil {
+		log.Printf("%s: Rejected upload: %s", video.srcPath, err.Error())
+		discardUpload(video)
+		return status, err
+	}
+
+	err = os.Rename(video.dlPath, video.srcPath)
+	if err != nil {
+		discardUpload(video)
+		return http.StatusInternalServerError, err
+	}
+
+	// Process the video
+	setVideoState(video, jobstatus.StateQueued)
+	activateVideo(video)
+	didAdd := fastProcessQueue.AddIfSpace(func() {
+		processVideoFast(video)
+	})
+
+	// If there is no space in the work queue delete the temporary files
+	if !didAdd {
+		log.Printf("%s: Process queue full: cancelling processsing", video.srcPath)
 
-	log.Printf("%s: Created owned file", video.srcPath)
+		removeVideoTempFiles(video)
+		releaseVideo(video)
+
+		return http.StatusServiceUnavailable, errors.New("Process queue full")
+	}
+
+	return http.StatusOK, nil
+}
+
+// JSON response describing where an uploaded video will be served from
+type uploadResponse struct {
+	Video     string `json:"video"`
+	Thumbnail string `json:"thumbnail"`
+	Hls       string `json:"hls,omitempty"`
+	Dash      string `json:"dash,omitempty"`
+	Sprites   string `json:"sprites,omitempty"`
+	DeleteUrl string `json:"deleteUrl"`
+	Title     string `json:"title,omitempty"`
+
+	// Resized thumbnails, see `thumbnailUrls`
+	Thumbnails map[string]map[string]string `json:"thumbnails,omitempty"`
+}
+
+func createUploadResponse(video *videoToTranscode) uploadResponse {
+	return uploadResponse{
+		Video:     video.url,
+		Thumbnail: video.thumbUrl,
+		Hls:       video.hlsUrl,
+		Dash:      video.dashUrl,
+		Sprites:   video.spriteVttUrl,
+		DeleteUrl: video.deleteUrl,
+		Title:     video.title,
+
+		Thumbnails: thumbnailUrls(video.token, video.servedVersion),
+	}
+}
+
+// Maximum size of an edit list form field in bytes
+const maxEditsSize = 64 * 1024
+
+// > POST /uploads
+// Uploads a new video to be transcoded and returns the URLs where the video
+// will be hosted.
+// Supports both raw data body and multipart form files.
+// The video can be trimmed with `start` and `end` or an edit list `edits`,
+// see `parseEdits`, as query parameters or form fields before the video.
+// The detected rotation can be overridden with `rotate`, see `parseRotate`,
+// and the thumbnail time with `thumbnail`, see `parseThumbnailTime`.
+func uploadHandler(w http.ResponseWriter, r *http.Request, user string) (int, error) {
+
+	query := r.URL.Query()
+	edits, err := parseEdits(query.Get("start"), query.Get("end"), query.Get("edits"))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	rotate, err := parseRotate(query.Get("rotate"))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	thumbnailTime, err := parseThumbnailTime(query.Get("thumbnail"))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	callbackUrl, err := parseCallbackUrl(query.Get("callback"))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	// Refuse uploads that are known to be too large before reading anything,
+	// the length is -1 if the client didn't send it
+	contentLength := r.ContentLength
+	if contentLength < 0 {
+		contentLength = 0
+	}
+	status, err := checkUploadAdmission(contentLength)
+	if err != nil {
+		return status, err
+	}
+
+	// Generate an unique token and assign the file to the current user
+	video, err := reserveVideo(edits, user)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// The client only learns the token if the upload succeeds, so there is no
+	// point in remembering the status or the files of failed uploads.
+	// `queueDownloadedVideo` cleans up after itself if it fails.
+	setVideoStatus(video, jobstatus.StateDownloading)
+	didDownload := false
+	didQueue := false
+	defer func() {
+		if !didDownload {
+			discardUpload(video)
+		}
+		if !didQueue {
+			jobs.Remove(video.token)
+		}
+	}()
 
 	// Create a temporary file for the download
 	dlFile, err := os.Create(video.dlPath)
@@ -572,7 +1325,7 @@ func uploadHandler(w http.ResponseWriter, r *http.Request, user string) (int, er
 			return http.StatusBadRequest, err
 		}
 
-		didDownload := false
+		didReceive := false
 
 		// Iterate through the multipart parts. This has to be done this way so
 		// the request can be streamed instead of held completely in memory
@@ -595,18 +1348,34 @@ func uploadHandler(w http.ResponseWriter, r *http.Request, user string) (int, er
 
 				title = part.FileName()
 
-				_, err = io.Copy(dlFile, part)
-				if err != nil {
+				_, err = copyUpload(dlFile, part)
+				if err == errUploadTooLarge {
+					return http.StatusRequestEntityTooLarge, err
+				} else if err != nil {
 					return http.StatusInternalServerError, err
 				}
 
-				didDownload = true
+				didReceive = true
+			}
+
+			// The edit list can also be sent as a form field
+			if part.FormName() == "edits" {
+				editsStr, err := ioutil.ReadAll(io.LimitReader(part, maxEditsSize))
+				if err != nil {
+					return http.StatusBadRequest, err
+				}
+
+				edits, err := parseEdits(query.Get("start"), query.Get("end"), string(editsStr))
+				if err != nil {
+					return http.StatusBadRequest, err
+				}
+				video.trim.Ranges = edits
 			}
 
 			part.Close()
 		}
 
-		if !didDownload {
+		if !didReceive {
 			return http.StatusInternalServerError, errors.New("'video' not found in multipart data")
 		}
 
@@ -615,39 +1384,25 @@ func uploadHandler(w http.ResponseWriter, r *http.Request, user string) (int, er
 
 		log.Printf("%s: Downloading raw body data: %s", video.srcPath, contentType)
 
-		_, err = io.Copy(dlFile, r.Body)
-		if err != nil {
+		_, err = copyUpload(dlFile, r.Body)
+		if err == errUploadTooLarge {
+			return http.StatusRequestEntityTooLarge, err
+		} else if err != nil {
 			return http.StatusInternalServerError, err
 		}
 	}
 
-	log.Printf("%s: Downloaded video data", video.srcPath)
+	video.title = title
+	video.callbackUrl = callbackUrl
+	video.rotate = rotate
+	video.thumbnailTime = thumbnailTime
 
-	err = os.Rename(video.dlPath, video.srcPath)
+	didDownload = true
+	status, err = queueDownloadedVideo(video)
 	if err != nil {
-		return http.StatusInternalServerError, err
-	}
-
-	// Process the video
-	didAdd := fastProcessQueue.AddIfSpace(func() {
-		processVideoFast(video)
-	})
-
-	// If there is no space in the work queue delete the temporary files
-	if !didAdd {
-		log.Printf("%s: Process queue full: cancelling processsing", video.srcPath)
-
-		err := os.Remove(video.srcPath)
-		logError(err, video.srcPath, "Delete source file")
-
-		err = serveCollection.Delete(video.servePath)
-		logError(err, video.srcPath, "Delete serve video file")
-
-		err = serveCollection.Delete(video.thumbServePath)
-		logError(err, video.srcPath, "Delete serve thumbnail file")
-
-		return http.StatusServiceUnavailable, errors.New("Process queue full")
+		return status, err
 	}
+	didQueue = true
 
 	// The video is uploaded and currently queued for transcoding, return either
 	// a JSON object describing it, or alternatively redirect the user to
@@ -659,10 +1414,27 @@ func uploadHandler(w http.ResponseWriter, r *http.Request, user string) (int, er
 			return http.StatusBadRequest, err
 		}
 
+		// The same URLs as in the JSON response, the resized thumbnails as
+		// `thumb_url_$format_$width`, eg. `thumb_url_webp_320w`
+		response := createUploadResponse(video)
 		values := redirectUrl.Query()
-		values.Add("video_url", video.url)
-		values.Add("thumb_url", video.thumbUrl)
-		values.Add("delete_url", video.deleteUrl)
+		values.Add("video_url", response.Video)
+		values.Add("thumb_url", response.Thumbnail)
+		if response.Hls != "" {
+			values.Add("hls_url", response.Hls)
+		}
+		if response.Dash != "" {
+			values.Add("dash_url", response.Dash)
+		}
+		if response.Sprites != "" {
+			values.Add("sprites_url", response.Sprites)
+		}
+		for format, widths := range response.Thumbnails {
+			for width, thumbnailUrl := range widths {
+				values.Add(fmt.Sprintf("thumb_url_%s_%s", format, width), thumbnailUrl)
+			}
+		}
+		values.Add("delete_url", response.DeleteUrl)
 		if title != "" {
 			values.Add("title", title)
 		}
@@ -672,18 +1444,7 @@ func uploadHandler(w http.ResponseWriter, r *http.Request, user string) (int, er
 
 		return http.StatusFound, nil
 	} else {
-		ret := struct {
-			Video     string `json:"video"`
-			Thumbnail string `json:"thumbnail"`
-			DeleteUrl string `json:"deleteUrl"`
-			Title     string `json:"title,omitempty"`
-		}{
-			video.url,
-			video.thumbUrl,
-			video.deleteUrl,
-			title,
-		}
-		err = json.NewEncoder(w).Encode(ret)
+		err = json.NewEncoder(w).Encode(createUploadResponse(video))
 		if err != nil {
 			log.Printf("Failed to send response: %s", err.Error())
 		}
@@ -692,67 +1453,193 @@ func uploadHandler(w http.ResponseWriter, r *http.Request, user string) (int, er
 	}
 }
 
-// > DELETE /uploads/:token
-// Deletes the video if the user owns it
-func deleteHandler(w http.ResponseWriter, r *http.Request) (int, error) {
+// > GET /uploads/:token
+// Returns the processing status of the video as JSON, see `jobstatus.Status`
+func statusHandler(w http.ResponseWriter, r *http.Request) (int, error) {
 
-	// Ignore the body (read to /dev/null)
-	_, err := io.Copy(ioutil.Discard, r.Body)
+	vars := mux.Vars(r)
+	token := vars["token"]
+
+	status, ok := jobs.Get(token)
+	if !ok {
+		return http.StatusNotFound, errors.New("Video not found")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(status)
 	if err != nil {
-		return http.StatusBadRequest, err
+		log.Printf("Failed to send response: %s", err.Error())
+	}
+
+	return http.StatusOK, nil
+}
+
+// Interval of comments sent to keep idle event streams open through proxies
+const eventsKeepAlive = 15 * time.Second
+
+// Write a single server-sent event with the status as JSON data
+func writeStatusEvent(w http.ResponseWriter, eventType string, status jobstatus.Status) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, data)
+	if err != nil {
+		return err
 	}
 
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+// > GET /uploads/:token/events
+// Streams the status of the video as server-sent events until it's finished:
+// `phase` events when the state changes and `progress` events while
+// transcoding, both carrying the same JSON as `statusHandler`
+func eventsHandler(w http.ResponseWriter, r *http.Request) (int, error) {
+
 	vars := mux.Vars(r)
 	token := vars["token"]
 
-	// Delete the owned files
+	if _, ok := w.(http.Flusher); !ok {
+		return http.StatusInternalServerError, errors.New("Streaming is not supported")
+	}
 
-	if useAWS {
-		if err != nil {
-			return http.StatusForbidden, err
+	// Subscribe before reading the status so no change is missed in between
+	events, unsubscribe := jobs.Subscribe(token)
+	defer unsubscribe()
+
+	status, ok := jobs.Get(token)
+	if !ok {
+		return http.StatusNotFound, errors.New("Video not found")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// The current status first so the client doesn't need a separate request
+	err := writeStatusEvent(w, jobstatus.EventPhase, status)
+	if err != nil || status.State.IsFinished() {
+		return http.StatusOK, nil
+	}
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			// The video was deleted
+			if !ok {
+				return http.StatusOK, nil
+			}
+
+			err := writeStatusEvent(w, event.Type, event.Status)
+			if err != nil || event.Status.State.IsFinished() {
+				return http.StatusOK, nil
+			}
+
+		case <-keepAlive.C:
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return http.StatusOK, nil
+			}
+			w.(http.Flusher).Flush()
+
+		case <-r.Context().Done():
+			return http.StatusOK, nil
 		}
+	}
+}
+
+// Returns the owner of the video `token`. Some backends store nothing until
+// the files are done so the owner of a video that is still being processed
+// is read from the job.
+func videoOwner(token string) (string, error) {
+	owner, err := backend.Owner(token + ".mp4")
+	if !storage.IsNotExist(err) {
+		return owner, err
+	}
 
-		_, videoErr := deleteFromAWS("videos/" + token + ".mp4")
-		_, thumbErr := deleteFromAWS("thumbs/" + token + ".jpg")
+	if owner, ok := activeVideoOwner(token); ok {
+		return owner, nil
+	}
 
-		if videoErr == nil && thumbErr == nil {
-			w.WriteHeader(http.StatusNoContent)
-			return http.StatusNoContent, nil
-		} else if videoErr != nil {
-			return http.StatusInternalServerError, videoErr
-		} else if thumbErr != nil {
-			return http.StatusInternalServerError, thumbErr
+	for _, name := range []string{token + ".job.json", token + ".orig.json"} {
+		manifest, manifestErr := readManifest(path.Join(tempBase, name))
+		if manifestErr == nil {
+			return manifest.Owner, nil
 		}
+	}
 
-	} else {
-		serveVideoPath := path.Join(serveBase, token+".mp4")
-		serveThumbPath := path.Join(serveBase, token+".jpg")
+	return "", err
+}
+
+// > DELETE /uploads/:token
+// Deletes the video if the user owns it, or any video if authenticated with
+// the master secret. The processing is stopped before anything is deleted so
+// the deleted files are not created again.
+func deleteHandler(w http.ResponseWriter, r *http.Request, user string, admin bool) (int, error) {
 
-		videoErr := serveCollection.Delete(serveVideoPath)
-		thumbErr := serveCollection.Delete(serveThumbPath)
+	// Ignore the body (read to /dev/null)
+	_, err := io.Copy(ioutil.Discard, r.Body)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
 
-		logError(videoErr, serveVideoPath, "Delete file")
-		logError(thumbErr, serveThumbPath, "Delete file")
+	vars := mux.Vars(r)
+	token := vars["token"]
 
-		if videoErr == nil && thumbErr == nil {
-			w.WriteHeader(http.StatusNoContent)
-			return http.StatusNoContent, nil
-		}
+	owner, err := videoOwner(token)
+	if storage.IsNotExist(err) {
+		return http.StatusNotFound, errors.New("Video not found")
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !admin && owner != user {
+		return http.StatusForbidden, errors.New("Video is owned by another user")
+	}
 
-		if ownedfile.IsPermissionDenied(videoErr) {
-			return http.StatusForbidden, videoErr
-		} else if ownedfile.IsPermissionDenied(thumbErr) {
-			return http.StatusForbidden, thumbErr
-		} else if videoErr != nil {
-			return http.StatusInternalServerError, videoErr
-		} else if thumbErr != nil {
-			return http.StatusInternalServerError, thumbErr
+	// Stop processing and wait for the files being stored
+	cancelVideo(token)
+	discardRetainedSource(token)
+
+	// Delete the owned files, the files of a video that was still processing
+	// and the optional outputs enabled after the upload may not exist
+	names := servedFileNames(token)
+	errs := make([]error, len(names))
+	for i, name := range names {
+		var err error
+		if admin {
+			err = backend.DeleteAny(name)
 		} else {
-			return http.StatusInternalServerError, errors.New("Forbidden code path")
+			err = backend.Delete(name, user)
+		}
+		if storage.IsNotExist(err) {
+			err = nil
+		}
+		logError(err, name, "Delete file")
+		errs[i] = err
+	}
+
+	for _, err := range errs {
+		if storage.IsPermissionDenied(err) {
+			return http.StatusForbidden, err
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return http.StatusInternalServerError, err
 		}
 	}
 
-	return http.StatusInternalServerError, errors.New("Forbidden code path")
+	jobs.Remove(token)
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
 }
 
 // Scans the temporary directories for files, if found add them to the
@@ -785,34 +1672,85 @@ func queuePendingVideosToTranscode() {
 
 		token := strings.TrimSuffix(parts[len(parts)-1], ".src.mp4")
 
-		serveVideoPath := path.Join(serveBase, token+".mp4")
-		serveThumbPath := path.Join(serveBase, token+".jpg")
+		videoName := token + ".mp4"
+		thumbName := token + ".jpg"
 
-		videoOwner, err := serveCollection.ReadOwner(serveVideoPath)
-		if err != nil {
-			log.Printf("%s: Failed to read video owner", p)
-			continue
-		}
+		// Restore the processing options and the reached phase from the
+		// manifest, videos without one are processed from the start untrimmed
+		state := jobstatus.StateQueued
+		manifestPath := path.Join(tempBase, token+".job.json")
+		manifest, err := readManifest(manifestPath)
 
-		thumbOwner, err := serveCollection.ReadOwner(serveThumbPath)
-		if err != nil {
-			log.Printf("%s: Failed to read thumbnail owner", p)
-			continue
-		}
+		var video *videoToTranscode
+		if err == nil {
+			if manifest.Storage != backend.Name() {
+				log.Printf("%s: Manifest storage %s does not match the current storage %s",
+					p, manifest.Storage, backend.Name())
+				continue
+			}
 
-		if videoOwner != thumbOwner {
-			log.Printf("%s: Owner mismatch", p)
-			continue
+			// The video may not be stored yet, but if it is it has to match
+			videoOwner, err := backend.Owner(videoName)
+			if err == nil && videoOwner != manifest.Owner {
+				log.Printf("%s: Manifest owner mismatch", p)
+				continue
+			}
+
+			video = videoFromManifest(token, manifest)
+			state = manifest.State
+		} else {
+			log.Printf("%s: Failed to read manifest, processing without options: %s", p, err)
+
+			videoOwner, err := backend.Owner(videoName)
+			if err != nil {
+				log.Printf("%s: Failed to read video owner", p)
+				continue
+			}
+
+			thumbOwner, err := backend.Owner(thumbName)
+			if err != nil {
+				log.Printf("%s: Failed to read thumbnail owner", p)
+				continue
+			}
+
+			if videoOwner != thumbOwner {
+				log.Printf("%s: Owner mismatch", p)
+				continue
+			}
+
+			video = createVideoToTranscode(token, nil, videoOwner)
 		}
 
-		video := createVideoToTranscode(token, serveVideoPath, serveThumbPath, nil, nil, videoOwner)
+		activateVideo(video)
 
-		didAdd := fastProcessQueue.AddIfSpace(func() {
-			processVideoFast(video)
-		})
+		var didAdd bool
+		switch state {
+
+		case jobstatus.StateDone, jobstatus.StateFailed:
+			// Crashed after the final state was written but before cleaning
+			// up, nothing left to process
+			log.Printf("%s: Already processed", video.srcPath)
+			removeVideoTempFiles(video)
+			continue
+
+		case jobstatus.StateLowQualityReady, jobstatus.StateSlowTranscoding:
+			// Low quality version and thumbnail exist, resume from the slow pass
+			setVideoStatus(video, jobstatus.StateLowQualityReady)
+			didAdd = slowProcessQueue.AddIfSpace(func() {
+				processVideoSlow(video)
+			})
+
+		default:
+			setVideoStatus(video, jobstatus.StateQueued)
+			didAdd = fastProcessQueue.AddIfSpace(func() {
+				processVideoFast(video)
+			})
+		}
 
 		if !didAdd {
 			log.Printf("%s: Process queue full: skipped", video.srcPath)
+			deactivateVideo(video)
+			jobs.Remove(video.token)
 		} else {
 			log.Printf("%s: Added to process queue", video.srcPath)
 		}
@@ -838,37 +1776,72 @@ func main() {
 	// Standalone:
 	//   GOTR_URI: URL of this server
 	//   AUTH_URI: URL of the authentication /userinfo endpoint
+	//
+	// Storage:
+	//   GOTR_STORAGE_BACKEND: Where to store the processed files: "local" or "aws" (default from USE_AWS)
+	//
 	// Amazon AWS S3:
-	//   USE_AWS: Whether to enable AWS or not
+	//   USE_AWS: Whether to enable AWS or not, required if GOTR_STORAGE_BACKEND is not set
 	//   AWS_BUCKET_NAME: The name of your bucket
 	//   AWS_BUCKET_REGION: The region your S3 bucket is located at
 	//   AWS_ACCESS_KEY_ID: The secret id for your app
 	//   AWS_SECRET_ACCESS_KEY : The secret key for your AWS
+	//   AWS_ENDPOINT: URL of an S3 compatible server to use instead of AWS (optional)
 	//
 	// Optional:
 	//   GOTR_FAST_TRANSCODE_THREADS: Number of workers that do fast low latency work (default 4)
 	//   GOTR_SLOW_TRANSCODE_THREADS: Number of workerst that do slow, but higher quality work (default 1)
+	//   GOTR_HLS: Whether to produce HLS adaptive streaming output in the slow pass (default false)
+	//   GOTR_DASH: Whether to produce MPEG-DASH adaptive streaming output in the slow pass (default false)
+	//   GOTR_RENDITIONS: Rendition ladder for HLS and DASH as height:videoKbps[:audioKbps],... (default 240:400:64,480:1000:96,720:2500:128)
+	//   GOTR_SPRITE_INTERVAL: Seconds between the frames of the seek preview sprite sheet, 0 disables it (default 0)
+	//   GOTR_THUMBNAIL_SIZES: Widths of the resized thumbnails in JPEG and WebP as 160w,320w,... (default none)
+	//   GOTR_TRANSCODER: Tools to transcode with: "ffmpeg" or "libav" (default detected from PATH, ffmpeg preferred)
+	//   GOTR_MAX_DURATION: Maximum length of uploaded videos in seconds (default unlimited)
+	//   GOTR_MAX_RESOLUTION: Maximum resolution of uploaded videos as WIDTHxHEIGHT in either orientation (default unlimited)
+	//   GOTR_MAX_UPLOAD_SIZE: Maximum size of uploaded videos in bytes (default unlimited)
+	//   GOTR_MIN_FREE_SPACE: Free disk space in bytes required to accept uploads, 0 disables the check (default 268435456)
+	//   GOTR_TRANSCODE_TIMEOUT_FACTOR: Allowed transcoding time per second of video and per pass (default 10)
+	//   GOTR_MIN_TRANSCODE_TIMEOUT: Transcoding time in seconds allowed in addition to the above (default 300)
+	//   GOTR_WEBHOOK_URL: URL to POST the processing phases of every video to
+	//   GOTR_WEBHOOK_SECRET: Key used to sign the webhook events (default hex HMAC-SHA256 of "webhook" keyed with GOTR_DELETE_SECRET)
+	//   GOTR_SOURCE_RETENTION: Seconds to keep the uploaded sources for re-editing, 0 disables re-editing (default 0)
+	//   GOTR_TUS_EXPIRY: Seconds to keep incomplete resumable uploads after they last received data, 0 keeps them (default 86400)
 
 	layersApiUri := strings.TrimSuffix(os.Getenv("LAYERS_API_URI"), "/")
 
 	var err error
-	useAWS, err = strconv.ParseBool(os.Getenv("USE_AWS"))
+	storageBackend := os.Getenv("GOTR_STORAGE_BACKEND")
+	if storageBackend == "" {
+		useAWS, err := strconv.ParseBool(os.Getenv("USE_AWS"))
 
-	if err != nil {
-		log.Printf("Could not parse useAWS variable from environment: %s", err)
+		if err != nil {
+			log.Printf("Could not parse useAWS variable from environment: %s", err)
+			os.Exit(11)
+		}
+
+		if useAWS {
+			storageBackend = "aws"
+		} else {
+			storageBackend = "local"
+		}
+	}
+
+	if storageBackend != "local" && storageBackend != "aws" {
+		log.Printf("Unknown storage backend %s, use 'local' or 'aws'", storageBackend)
 		os.Exit(11)
 	}
 
-	bucketName = os.Getenv("AWS_BUCKET_NAME")
+	bucketName := os.Getenv("AWS_BUCKET_NAME")
 
-	bucketRegion = os.Getenv("AWS_BUCKET_REGION")
+	bucketRegion := os.Getenv("AWS_BUCKET_REGION")
 
-	if bucketName == "" && useAWS {
+	if bucketName == "" && storageBackend == "aws" {
 		log.Printf("Bucket name is required if using AWS!")
 		os.Exit(11)
 	}
 
-	if bucketRegion == "" && useAWS {
+	if bucketRegion == "" && storageBackend == "aws" {
 		log.Printf("Bucket region is required if using AWS!")
 		os.Exit(11)
 	}
@@ -880,19 +1853,6 @@ func main() {
 		os.Exit(11)
 	}
 
-	if useAWS {
-		s3Client = s3.New(session.New(&aws.Config{Region: aws.String(bucketRegion)}))
-		s3Uploader = s3manager.NewUploader(session.New(&aws.Config{Region: aws.String(bucketRegion)}))
-
-		err := s3Client.WaitUntilBucketExists(&s3.HeadBucketInput{Bucket: &bucketName})
-
-		if err != nil {
-			log.Printf("Failed to wait for bucket to exist %s, %s", bucketName, err)
-			os.Exit(11)
-		}
-
-	}
-
 	appUri := strings.TrimSuffix(os.Getenv("GOTR_URI"), "/")
 	if appUri == "" {
 		appUri = layersApiUri
@@ -950,6 +1910,146 @@ func main() {
 		}
 	}
 
+	if os.Getenv("GOTR_HLS") != "" {
+		var err error
+		useHLS, err = strconv.ParseBool(os.Getenv("GOTR_HLS"))
+		if err != nil {
+			log.Printf("Expected a boolean for GOTR_HLS")
+			os.Exit(11)
+		}
+	}
+	if os.Getenv("GOTR_DASH") != "" {
+		var err error
+		useDASH, err = strconv.ParseBool(os.Getenv("GOTR_DASH"))
+		if err != nil {
+			log.Printf("Expected a boolean for GOTR_DASH")
+			os.Exit(11)
+		}
+	}
+
+	renditions = transcode.DefaultRenditions
+	if os.Getenv("GOTR_RENDITIONS") != "" {
+		var err error
+		renditions, err = transcode.ParseRenditions(os.Getenv("GOTR_RENDITIONS"))
+		if err != nil {
+			log.Printf("Failed to parse GOTR_RENDITIONS: %s", err)
+			os.Exit(11)
+		}
+	}
+
+	if os.Getenv("GOTR_SPRITE_INTERVAL") != "" {
+		var err error
+		spriteInterval, err = strconv.ParseFloat(os.Getenv("GOTR_SPRITE_INTERVAL"), 64)
+		if err != nil || spriteInterval < 0.0 {
+			log.Printf("Expected a non-negative number for GOTR_SPRITE_INTERVAL")
+			os.Exit(11)
+		}
+	}
+
+	if os.Getenv("GOTR_THUMBNAIL_SIZES") != "" {
+		var err error
+		thumbnailWidths, err = transcode.ParseThumbnailWidths(os.Getenv("GOTR_THUMBNAIL_SIZES"))
+		if err != nil {
+			log.Printf("Failed to parse GOTR_THUMBNAIL_SIZES: %s", err)
+			os.Exit(11)
+		}
+	}
+
+	if os.Getenv("GOTR_MAX_DURATION") != "" {
+		var err error
+		maxDuration, err = strconv.ParseFloat(os.Getenv("GOTR_MAX_DURATION"), 64)
+		if err != nil || maxDuration < 0.0 {
+			log.Printf("Expected a non-negative number for GOTR_MAX_DURATION")
+			os.Exit(11)
+		}
+	}
+	if os.Getenv("GOTR_MAX_RESOLUTION") != "" {
+		var err error
+		maxWidth, maxHeight, err = parseResolution(os.Getenv("GOTR_MAX_RESOLUTION"))
+		if err != nil {
+			log.Printf("Failed to parse GOTR_MAX_RESOLUTION: %s", err)
+			os.Exit(11)
+		}
+	}
+
+	if os.Getenv("GOTR_MAX_UPLOAD_SIZE") != "" {
+		var err error
+		maxUploadSize, err = strconv.ParseInt(os.Getenv("GOTR_MAX_UPLOAD_SIZE"), 10, 64)
+		if err != nil || maxUploadSize < 0 {
+			log.Printf("Expected a non-negative number for GOTR_MAX_UPLOAD_SIZE")
+			os.Exit(11)
+		}
+	}
+	if os.Getenv("GOTR_MIN_FREE_SPACE") != "" {
+		var err error
+		minFreeSpace, err = strconv.ParseInt(os.Getenv("GOTR_MIN_FREE_SPACE"), 10, 64)
+		if err != nil || minFreeSpace < 0 {
+			log.Printf("Expected a non-negative number for GOTR_MIN_FREE_SPACE")
+			os.Exit(11)
+		}
+	}
+
+	if os.Getenv("GOTR_TRANSCODE_TIMEOUT_FACTOR") != "" {
+		var err error
+		transcodeTimeoutFactor, err = strconv.ParseFloat(os.Getenv("GOTR_TRANSCODE_TIMEOUT_FACTOR"), 64)
+		if err != nil || transcodeTimeoutFactor <= 0.0 {
+			log.Printf("Expected a positive number for GOTR_TRANSCODE_TIMEOUT_FACTOR")
+			os.Exit(11)
+		}
+	}
+	if os.Getenv("GOTR_MIN_TRANSCODE_TIMEOUT") != "" {
+		seconds, err := strconv.Atoi(os.Getenv("GOTR_MIN_TRANSCODE_TIMEOUT"))
+		if err != nil || seconds <= 0 {
+			log.Printf("Expected a positive number for GOTR_MIN_TRANSCODE_TIMEOUT")
+			os.Exit(11)
+		}
+		minTranscodeTimeout = time.Duration(seconds) * time.Second
+	}
+
+	if os.Getenv("GOTR_TUS_EXPIRY") != "" {
+		seconds, err := strconv.Atoi(os.Getenv("GOTR_TUS_EXPIRY"))
+		if err != nil || seconds < 0 {
+			log.Printf("Expected a non-negative number for GOTR_TUS_EXPIRY")
+			os.Exit(11)
+		}
+		tusUploadExpiry = time.Duration(seconds) * time.Second
+	}
+
+	if os.Getenv("GOTR_SOURCE_RETENTION") != "" {
+		seconds, err := strconv.Atoi(os.Getenv("GOTR_SOURCE_RETENTION"))
+		if err != nil || seconds < 0 {
+			log.Printf("Expected a non-negative number for GOTR_SOURCE_RETENTION")
+			os.Exit(11)
+		}
+		sourceRetention = time.Duration(seconds) * time.Second
+	}
+
+	webhookUrl, err = parseCallbackUrl(os.Getenv("GOTR_WEBHOOK_URL"))
+	if err != nil {
+		log.Printf("Failed to parse GOTR_WEBHOOK_URL: %s", err)
+		os.Exit(11)
+	}
+
+	// Never sign with the master secret itself, it authorizes deleting
+	webhookSecret := os.Getenv("GOTR_WEBHOOK_SECRET")
+	if webhookSecret == "" {
+		webhookSecret = webhook.DeriveSecret(deleteSecret)
+	}
+	webhooks = webhook.NewSender(webhookSecret)
+	callbacks = webhook.NewPublicSender(webhookSecret)
+
+	var transcoder transcode.Transcoder
+	if os.Getenv("GOTR_TRANSCODER") != "" {
+		transcoder, err = transcode.TranscoderByName(os.Getenv("GOTR_TRANSCODER"))
+	} else {
+		transcoder, err = transcode.DetectTranscoder()
+	}
+	if err != nil {
+		log.Printf("Failed to find a transcoder: %s", err)
+		os.Exit(11)
+	}
+	transcode.SetTranscoder(transcoder)
+
 	storageUri = strings.TrimSuffix(appUri+os.Getenv("GOTR_STORAGE_URL_PATH"), "/")
 	apiUri = strings.TrimSuffix(appUri+os.Getenv("GOTR_API_URL_PATH"), "/")
 	tempBase = os.Getenv("GOTR_TEMP_PATH")
@@ -968,8 +2068,38 @@ func main() {
 		os.Exit(11)
 	}
 
+	if storageBackend == "aws" {
+		s3Backend, err := storage.NewS3(bucketName, bucketRegion, os.Getenv("AWS_ENDPOINT"))
+		if err != nil {
+			log.Printf("Failed to wait for bucket to exist %s, %s", bucketName, err)
+			os.Exit(11)
+		}
+		backend = s3Backend
+	} else {
+		backend = storage.NewLocal(serveCollection, serveBase, storageUri)
+	}
+
+	// Leave out the resized thumbnails the encoder can't produce
+	if len(thumbnailWidths) > 0 {
+		thumbnailFormats, err = transcode.SupportedThumbnailFormats(tempBase)
+		if err != nil {
+			log.Printf("Failed to check the thumbnail formats: %s", err)
+			os.Exit(11)
+		}
+		if len(thumbnailFormats) < len(transcode.ThumbnailFormats) {
+			log.Printf("The transcoder can't produce some thumbnail formats, serving only %v", thumbnailFormats)
+		}
+	}
+
 	log.Printf("Configuration successful")
-	log.Printf("  %12s: %t", "Use AWS", useAWS)
+	log.Printf("  %12s: %s", "Storage", backend.Name())
+	log.Printf("  %12s: %s", "Transcoder", transcoder.Name())
+	log.Printf("  %12s: %s + %gx duration", "Timeout", minTranscodeTimeout, transcodeTimeoutFactor)
+	log.Printf("  %12s: %gs, %dx%d", "Upload limits", maxDuration, maxWidth, maxHeight)
+	log.Printf("  %12s: %d bytes max, %d bytes free", "Upload size", maxUploadSize, minFreeSpace)
+	log.Printf("  %12s: %s", "Webhook", webhookUrl)
+	log.Printf("  %12s: %s", "Retention", sourceRetention)
+	log.Printf("  %12s: %s", "tus expiry", tusUploadExpiry)
 	log.Printf("  %12s: %s", "AWS bucket name", bucketName)
 	log.Printf("  %12s: %s", "AWS bucket region", bucketRegion)
 	log.Printf("  %12s: %s", "Auth URI", authUri)
@@ -978,19 +2108,49 @@ func main() {
 	log.Printf("  %12s: %s", "Temp path", tempBase)
 	log.Printf("  %12s: %s", "Serve path", serveBase)
 	log.Printf("  %12s: %d fast, %d slow", "Threads", numFastTranscodeThreads, numSlowTranscodeThreads)
+	log.Printf("  %12s: %t HLS, %t DASH", "Streaming", useHLS, useDASH)
+	for _, rendition := range renditions {
+		log.Printf("  %12s: %s %dk video, %dk audio", "Rendition", rendition.Name(), rendition.VideoBitrate, rendition.AudioBitrate)
+	}
+	log.Printf("  %12s: %v %v", "Thumbnails", thumbnailWidths, thumbnailFormats)
+	log.Printf("  %12s: every %gs", "Sprites", spriteInterval)
 
 	// If there is pending work to do add it to the work queue
 	log.Printf("Searching for pending work")
 	queuePendingVideosToTranscode()
 
+	// Forget retained sources periodically
+	if sourceRetention > 0 {
+		go pruneRetainedSourcesPeriodically()
+	}
+
+	// Remove abandoned resumable uploads periodically
+	if tusUploadExpiry > 0 {
+		go pruneExpiredTusUploadsPeriodically()
+	}
+
 	// Setup the router and start serving
 	r := mux.NewRouter()
 
+	r.HandleFunc("/uploads/tus", wrappedHandler(tusProtocolHandler(authenticateOIDCHandler(tusCreateHandler)))).Methods("POST")
+	r.HandleFunc("/uploads/tus/{token}", wrappedHandler(tusProtocolHandler(authenticateOIDCHandler(tusHeadHandler)))).Methods("HEAD")
+	r.HandleFunc("/uploads/tus/{token}", wrappedHandler(tusProtocolHandler(authenticateOIDCHandler(tusPatchHandler)))).Methods("PATCH")
+	r.HandleFunc("/uploads/tus/{token}", wrappedHandler(tusProtocolHandler(authenticateOIDCHandler(tusDeleteHandler)))).Methods("DELETE")
+
+	r.HandleFunc("/uploads/tus", wrappedHandler(tusProtocolHandler(tusOptionsHandler("POST")))).Methods("OPTIONS")
+	r.HandleFunc("/uploads/tus/{token}", wrappedHandler(tusProtocolHandler(tusOptionsHandler("HEAD", "PATCH", "DELETE")))).Methods("OPTIONS")
+
 	r.HandleFunc("/uploads", wrappedHandler(authenticateOIDCHandler(uploadHandler))).Methods("POST")
-	r.HandleFunc("/uploads/{token}", wrappedHandler(authenticateSecretHandler(deleteHandler))).Methods("DELETE")
+	r.HandleFunc("/uploads/{token}", wrappedHandler(statusHandler)).Methods("GET")
+	r.HandleFunc("/uploads/{token}/events", wrappedHandler(eventsHandler)).Methods("GET")
+	r.HandleFunc("/uploads/{token}", wrappedHandler(authenticateSecretOrOIDCHandler(reeditHandler))).Methods("PATCH")
+	r.HandleFunc("/uploads/{token}", wrappedHandler(authenticateSecretOrOIDCHandler(deleteHandler))).Methods("DELETE")
+	r.HandleFunc("/uploads/{token}/thumbnail", wrappedHandler(authenticateSecretOrOIDCHandler(thumbnailHandler))).Methods("PUT")
 
 	r.HandleFunc("/uploads", wrappedHandler(optionsHandler("POST"))).Methods("OPTIONS")
-	r.HandleFunc("/uploads/{token}", wrappedHandler(optionsHandler("DELETE"))).Methods("DELETE")
+	r.HandleFunc("/uploads/{token}", wrappedHandler(optionsHandler("GET", "PATCH", "DELETE"))).Methods("OPTIONS")
+	r.HandleFunc("/uploads/{token}/events", wrappedHandler(optionsHandler("GET"))).Methods("OPTIONS")
+	r.HandleFunc("/uploads/{token}/thumbnail", wrappedHandler(optionsHandler("PUT"))).Methods("OPTIONS")
 
 	port := ":8080"
 
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"../ownedfile"
+)
+
+// Stores files in a local directory that is served by a separate HTTP server
+// Ownership is tracked using `.owner` files, see the `ownedfile` package.
+type Local struct {
+	collection *ownedfile.Collection
+	root       string
+	baseUrl    string
+}
+
+// Create a new local storage
+// root: Directory to serve the files from, needs to be in the same mount as
+// the files passed to `Put` since they are renamed to the directory
+// baseUrl: URL that serves the files of `root`
+func NewLocal(collection *ownedfile.Collection, root string, baseUrl string) *Local {
+	return &Local{
+		collection: collection,
+		root:       root,
+		baseUrl:    baseUrl,
+	}
+}
+
+func (self *Local) path(name string) string {
+	return path.Join(self.root, name)
+}
+
+func (self *Local) Name() string {
+	return "local"
+}
+
+func (self *Local) Reserve(name string, owner string) error {
+	return self.collection.Create(self.path(name), owner)
+}
+
+func (self *Local) Put(src string, name string, contentType string, owner string) error {
+	err := self.collection.Move(src, self.path(name), owner)
+	if err != nil {
+		_ = os.Remove(src)
+		return err
+	}
+	return nil
+}
+
+// Directories are moved like files, so `src` must be in the same mount
+func (self *Local) PutDir(src string, name string, owner string) error {
+	err := self.collection.Move(src, self.path(name), owner)
+	if err != nil {
+		_ = os.RemoveAll(src)
+		return err
+	}
+	return nil
+}
+
+func (self *Local) Delete(name string, owner string) error {
+	err := self.collection.DeleteOwned(self.path(name), owner)
+
+	// The owner file is missing if the name was never reserved
+	if os.IsNotExist(err) {
+		return &notExistError{name: name}
+	}
+	return err
+}
+
+func (self *Local) DeleteAny(name string) error {
+	err := self.collection.Delete(self.path(name))
+	if os.IsNotExist(err) {
+		return &notExistError{name: name}
+	}
+	return err
+}
+
+func (self *Local) Owner(name string) (string, error) {
+	owner, err := self.collection.ReadOwner(self.path(name))
+	if os.IsNotExist(err) {
+		return "", &notExistError{name: name}
+	}
+	return owner, err
+}
+
+func (self *Local) Read(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(self.path(name))
+	if os.IsNotExist(err) {
+		return nil, &notExistError{name: name}
+	}
+	return data, err
+}
+
+func (self *Local) URL(name string) string {
+	return self.baseUrl + "/" + name
+}
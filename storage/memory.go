@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type memoryFile struct {
+	owner       string
+	contentType string
+	data        []byte
+}
+
+// Stores files in memory, useful for testing code that uses a `Backend`
+type Memory struct {
+	mutex   sync.Mutex
+	files   map[string]*memoryFile
+	baseUrl string
+}
+
+func NewMemory(baseUrl string) *Memory {
+	return &Memory{
+		mutex:   sync.Mutex{},
+		files:   make(map[string]*memoryFile),
+		baseUrl: baseUrl,
+	}
+}
+
+func (self *Memory) lock() {
+	self.mutex.Lock()
+}
+
+func (self *Memory) unlock() {
+	self.mutex.Unlock()
+}
+
+func (self *Memory) Name() string {
+	return "memory"
+}
+
+func (self *Memory) Reserve(name string, owner string) error {
+	self.lock()
+	defer self.unlock()
+
+	if _, ok := self.files[name]; ok {
+		return &permissionDeniedError{name: name}
+	}
+
+	self.files[name] = &memoryFile{owner: owner}
+	return nil
+}
+
+func (self *Memory) Put(src string, name string, contentType string, owner string) error {
+	defer os.Remove(src)
+
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	self.lock()
+	defer self.unlock()
+
+	file, ok := self.files[name]
+	if ok && file.owner != owner {
+		return &permissionDeniedError{name: name}
+	}
+
+	self.files[name] = &memoryFile{
+		owner:       owner,
+		contentType: contentType,
+		data:        data,
+	}
+	return nil
+}
+
+// Files in directories are stored flat as `name/$file`, the files of an
+// existing directory are replaced
+func (self *Memory) PutDir(src string, name string, owner string) error {
+	defer os.RemoveAll(src)
+
+	files := make(map[string]*memoryFile)
+	err := filepath.Walk(src, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		relPath, err := filepath.Rel(src, filePath)
+		if err != nil {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+
+		files[name+"/"+filepath.ToSlash(relPath)] = &memoryFile{
+			owner:       owner,
+			contentType: ContentTypeOf(filePath),
+			data:        data,
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	self.lock()
+	defer self.unlock()
+
+	fileOwner, err := self.unsafeOwner(name)
+	if err == nil && fileOwner != owner {
+		return &permissionDeniedError{name: name}
+	}
+
+	self.unsafeDelete(name)
+	for filePath, file := range files {
+		self.files[filePath] = file
+	}
+	return nil
+}
+
+// Returns the names of the file `name` or the files in the directory `name`
+// Note: Needs to be called with the lock held
+func (self *Memory) unsafeFind(name string) []string {
+	names := []string{}
+	for filePath := range self.files {
+		if filePath == name || strings.HasPrefix(filePath, name+"/") {
+			names = append(names, filePath)
+		}
+	}
+	return names
+}
+
+// Note: Needs to be called with the lock held
+func (self *Memory) unsafeOwner(name string) (string, error) {
+	names := self.unsafeFind(name)
+	if len(names) == 0 {
+		return "", &notExistError{name: name}
+	}
+	return self.files[names[0]].owner, nil
+}
+
+func (self *Memory) Delete(name string, owner string) error {
+	self.lock()
+	defer self.unlock()
+
+	fileOwner, err := self.unsafeOwner(name)
+	if err != nil {
+		return err
+	}
+
+	if fileOwner != owner {
+		return &permissionDeniedError{name: name}
+	}
+
+	self.unsafeDelete(name)
+	return nil
+}
+
+func (self *Memory) DeleteAny(name string) error {
+	self.lock()
+	defer self.unlock()
+
+	_, err := self.unsafeOwner(name)
+	if err != nil {
+		return err
+	}
+
+	self.unsafeDelete(name)
+	return nil
+}
+
+func (self *Memory) unsafeDelete(name string) {
+	for _, filePath := range self.unsafeFind(name) {
+		delete(self.files, filePath)
+	}
+}
+
+func (self *Memory) Owner(name string) (string, error) {
+	self.lock()
+	defer self.unlock()
+
+	return self.unsafeOwner(name)
+}
+
+// Reserved names have no data until they are stored
+func (self *Memory) Read(name string) ([]byte, error) {
+	self.lock()
+	defer self.unlock()
+
+	file, ok := self.files[name]
+	if !ok || file.data == nil {
+		return nil, &notExistError{name: name}
+	}
+	return file.data, nil
+}
+
+func (self *Memory) URL(name string) string {
+	return self.baseUrl + "/" + name
+}
@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Stores files in an Amazon S3 bucket
+// Ownership is stored in the object metadata `owner` and checked with a
+// HeadObject request before the object is replaced or deleted.
+type S3 struct {
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+	region   string
+	endpoint string
+}
+
+// Create a new S3 storage, waits until the bucket exists
+// endpoint: Optional URL of an S3 compatible server to use instead of AWS,
+// for example a local Minio instance for testing
+func NewS3(bucket string, region string, endpoint string) (*S3, error) {
+	config := &aws.Config{Region: aws.String(region)}
+	if endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	storage := &S3{
+		client:   s3.New(session.New(config)),
+		uploader: s3manager.NewUploader(session.New(config)),
+		bucket:   bucket,
+		region:   region,
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+	}
+
+	err := storage.client.WaitUntilBucketExists(&s3.HeadBucketInput{Bucket: &storage.bucket})
+	if err != nil {
+		return nil, err
+	}
+
+	return storage, nil
+}
+
+// Images are stored under `thumbs/` and everything else under `videos/`
+// Files in directories are stored under the same prefix as the directory.
+func (self *S3) key(name string) string {
+	root := strings.SplitN(name, "/", 2)[0]
+	switch path.Ext(root) {
+	case ".jpg":
+		return "thumbs/" + name
+	default:
+		return "videos/" + name
+	}
+}
+
+func (self *S3) Name() string {
+	return "aws"
+}
+
+// Returns true if the error is a 404 response from S3
+func isNotFound(err error) bool {
+	if requestErr, ok := err.(awserr.RequestFailure); ok {
+		return requestErr.StatusCode() == http.StatusNotFound
+	}
+	return false
+}
+
+// Check that the object `name` is owned by `owner`
+// Objects that don't exist yet are free to be taken by anyone.
+func (self *S3) checkOwner(name string, owner string) error {
+	fileOwner, err := self.Owner(name)
+	if IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if fileOwner != owner {
+		return &permissionDeniedError{name: name}
+	}
+	return nil
+}
+
+// Objects can't be reserved in S3, the name is owned when it's first `Put`,
+// but fail if the name is already taken
+func (self *S3) Reserve(name string, owner string) error {
+	_, err := self.Owner(name)
+	if IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return &permissionDeniedError{name: name}
+}
+
+// Upload the local file `src` as the object `key`
+func (self *S3) upload(src string, key string, contentType string, owner string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = self.uploader.Upload(&s3manager.UploadInput{
+		Bucket:      &self.bucket,
+		ContentType: &contentType,
+		Metadata:    map[string]*string{"owner": &owner},
+		Key:         &key,
+		Body:        file,
+	})
+	return err
+}
+
+func (self *S3) Put(src string, name string, contentType string, owner string) error {
+	defer os.Remove(src)
+
+	err := self.checkOwner(name, owner)
+	if err != nil {
+		return err
+	}
+
+	return self.upload(src, self.key(name), contentType, owner)
+}
+
+// S3 has no directories, every file is uploaded as `key(name)/$file`
+func (self *S3) PutDir(src string, name string, owner string) error {
+	defer os.RemoveAll(src)
+
+	err := self.checkOwner(name, owner)
+	if err != nil {
+		return err
+	}
+
+	prefix := self.key(name)
+	return filepath.Walk(src, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		relPath, err := filepath.Rel(src, filePath)
+		if err != nil {
+			return err
+		}
+
+		return self.upload(filePath, prefix+"/"+filepath.ToSlash(relPath), ContentTypeOf(filePath), owner)
+	})
+}
+
+// Returns the keys of the objects in the directory `prefix`
+func (self *S3) listDir(prefix string) ([]string, error) {
+	keys := []string{}
+	err := self.client.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: &self.bucket,
+		Prefix: aws.String(prefix + "/"),
+	}, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, aws.StringValue(object.Key))
+		}
+		return true
+	})
+	return keys, err
+}
+
+func (self *S3) Delete(name string, owner string) error {
+	fileOwner, err := self.Owner(name)
+	if err != nil {
+		return err
+	}
+	if fileOwner != owner {
+		return &permissionDeniedError{name: name}
+	}
+
+	return self.DeleteAny(name)
+}
+
+func (self *S3) DeleteAny(name string) error {
+	// The name can be either a single object or a directory
+	keys, err := self.listDir(self.key(name))
+	if err != nil {
+		return err
+	}
+	keys = append(keys, self.key(name))
+
+	for _, key := range keys {
+		_, err := self.client.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: &self.bucket,
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Read the owner from the metadata of the object `key`
+func (self *S3) headOwner(name string, key string) (string, error) {
+	head, err := self.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: &self.bucket,
+		Key:    &key,
+	})
+	if isNotFound(err) {
+		return "", &notExistError{name: name}
+	} else if err != nil {
+		return "", err
+	}
+
+	// S3 canonicalizes the metadata keys
+	for key, value := range head.Metadata {
+		if (key == "Owner" || key == "owner") && value != nil {
+			return *value, nil
+		}
+	}
+
+	return "", &notExistError{name: name}
+}
+
+// Directories are owned by the owner of the files in them
+func (self *S3) Owner(name string) (string, error) {
+	owner, err := self.headOwner(name, self.key(name))
+	if !IsNotExist(err) {
+		return owner, err
+	}
+
+	keys, err := self.listDir(self.key(name))
+	if err != nil {
+		return "", err
+	}
+	if len(keys) == 0 {
+		return "", &notExistError{name: name}
+	}
+
+	return self.headOwner(name, keys[0])
+}
+
+func (self *S3) Read(name string) ([]byte, error) {
+	object, err := self.client.GetObject(&s3.GetObjectInput{
+		Bucket: &self.bucket,
+		Key:    aws.String(self.key(name)),
+	})
+	if isNotFound(err) {
+		return nil, &notExistError{name: name}
+	} else if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+
+	return ioutil.ReadAll(object.Body)
+}
+
+func (self *S3) URL(name string) string {
+	if self.endpoint != "" {
+		return self.endpoint + "/" + self.bucket + "/" + self.key(name)
+	}
+	return "https://" + self.bucket + ".s3." + self.region + ".amazonaws.com/" + self.key(name)
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"fmt"
+	"path"
+
+	"../ownedfile"
+)
+
+// Storage for the processed files that are served to the users
+// Files are identified by a name relative to the storage root, for example
+// `$token.mp4`, the backend is free to map it to its own layout.
+type Backend interface {
+
+	// Short name of the backend used in configuration and job manifests
+	Name() string
+
+	// Reserve `name` for `owner` before the file itself exists
+	// Fails with a permission denied error if the name is already taken
+	Reserve(name string, owner string) error
+
+	// Move the local file `src` to be served as `name`
+	// `src` is consumed: it's removed even if storing fails
+	Put(src string, name string, contentType string, owner string) error
+
+	// Move the local directory `src` to be served as `name`, the files in it
+	// are served as `name/$file` with content types from `ContentTypeOf`
+	// `src` is consumed: it's removed even if storing fails
+	PutDir(src string, name string, owner string) error
+
+	// Remove the file `name` and its reservation
+	// Fails with a permission denied error if the file is not owned by `owner`
+	Delete(name string, owner string) error
+
+	// Remove the file `name` and its reservation whoever owns it, only for
+	// requests authenticated with the master secret
+	DeleteAny(name string) error
+
+	// Returns the owner of the file `name`
+	Owner(name string) (string, error)
+
+	// Returns the contents of the file `name`
+	Read(name string) ([]byte, error)
+
+	// Public URL where the file `name` is served from
+	URL(name string) string
+}
+
+// Content types of the files that are stored
+var contentTypes = map[string]string{
+	".json": "application/json",
+	".mp4":  "video/mp4",
+	".jpg":  "image/jpeg",
+	".webp": "image/webp",
+	".vtt":  "text/vtt",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+	".mpd":  "application/dash+xml",
+	".m4s":  "video/iso.segment",
+}
+
+// Returns the content type of a stored file based on its extension
+func ContentTypeOf(name string) string {
+	contentType, ok := contentTypes[path.Ext(name)]
+	if !ok {
+		return "application/octet-stream"
+	}
+	return contentType
+}
+
+type permissionDeniedError struct {
+	name string
+}
+
+func (self *permissionDeniedError) Error() string {
+	return fmt.Sprintf("storage %s: Permission denied, owned by another user", self.name)
+}
+
+type notExistError struct {
+	name string
+}
+
+func (self *notExistError) Error() string {
+	return fmt.Sprintf("storage %s: File does not exist", self.name)
+}
+
+// Returns true if the error was caused by the file being owned by someone else
+func IsPermissionDenied(err error) bool {
+	switch err.(type) {
+	case *permissionDeniedError:
+		return true
+	default:
+		return ownedfile.IsPermissionDenied(err)
+	}
+}
+
+// Returns true if the error was caused by the file not existing
+func IsNotExist(err error) bool {
+	switch err.(type) {
+	case *notExistError:
+		return true
+	default:
+		return false
+	}
+}
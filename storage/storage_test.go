@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"../ownedfile"
+)
+
+// Write a file with `data` to `dir` to be stored
+func writeSource(t *testing.T, dir string, name string, data string) string {
+	filePath := path.Join(dir, name)
+	err := ioutil.WriteFile(filePath, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+// Write a directory with `files` to `dir` to be stored
+func writeSourceDir(t *testing.T, dir string, name string, files map[string]string) string {
+	dirPath := path.Join(dir, name)
+	err := os.Mkdir(dirPath, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for fileName, data := range files {
+		writeSource(t, dirPath, fileName, data)
+	}
+	return dirPath
+}
+
+// Check that the file `name` contains `expected`
+func expectData(t *testing.T, backend Backend, name string, expected string) {
+	data, err := backend.Read(name)
+	if err != nil {
+		t.Errorf("%s: Reading %s failed: %s", backend.Name(), name, err)
+	} else if string(data) != expected {
+		t.Errorf("%s: %s contains %q, expected %q", backend.Name(), name, data, expected)
+	}
+}
+
+// Check that the file `name` is owned by `expected`
+func expectOwner(t *testing.T, backend Backend, name string, expected string) {
+	owner, err := backend.Owner(name)
+	if err != nil {
+		t.Errorf("%s: Reading the owner of %s failed: %s", backend.Name(), name, err)
+	} else if owner != expected {
+		t.Errorf("%s: %s is owned by %q, expected %q", backend.Name(), name, owner, expected)
+	}
+}
+
+// Check that the local file `src` was consumed by the backend
+func expectConsumed(t *testing.T, backend Backend, src string) {
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("%s: %s was not removed", backend.Name(), src)
+	}
+}
+
+// The behavior shared by all the backends, `srcDir` is for the files to store
+func testBackend(t *testing.T, backend Backend, srcDir string, baseUrl string) {
+	name := backend.Name()
+
+	if _, err := backend.Owner("video.mp4"); !IsNotExist(err) {
+		t.Errorf("%s: Expected the owner of a missing file to not exist, got %v", name, err)
+	}
+
+	// Reserving
+	if err := backend.Reserve("video.mp4", "alice"); err != nil {
+		t.Fatalf("%s: Reserve failed: %s", name, err)
+	}
+	if err := backend.Reserve("video.mp4", "bob"); !IsPermissionDenied(err) {
+		t.Errorf("%s: Expected reserving a taken name to be denied, got %v", name, err)
+	}
+	expectOwner(t, backend, "video.mp4", "alice")
+	if _, err := backend.Read("video.mp4"); !IsNotExist(err) {
+		t.Errorf("%s: Expected a reserved file to have no data, got %v", name, err)
+	}
+
+	// Storing files
+	src := writeSource(t, srcDir, "other.mp4", "other")
+	if err := backend.Put(src, "video.mp4", "video/mp4", "bob"); !IsPermissionDenied(err) {
+		t.Errorf("%s: Expected storing over a file of another user to be denied, got %v", name, err)
+	}
+	expectConsumed(t, backend, src)
+
+	src = writeSource(t, srcDir, "first.mp4", "first")
+	if err := backend.Put(src, "video.mp4", "video/mp4", "alice"); err != nil {
+		t.Errorf("%s: Put failed: %s", name, err)
+	}
+	expectConsumed(t, backend, src)
+	expectData(t, backend, "video.mp4", "first")
+
+	src = writeSource(t, srcDir, "second.mp4", "second")
+	if err := backend.Put(src, "video.mp4", "video/mp4", "alice"); err != nil {
+		t.Errorf("%s: Replacing with Put failed: %s", name, err)
+	}
+	expectData(t, backend, "video.mp4", "second")
+	expectOwner(t, backend, "video.mp4", "alice")
+
+	// Storing directories
+	if err := backend.Reserve("video.hls", "alice"); err != nil {
+		t.Fatalf("%s: Reserve failed: %s", name, err)
+	}
+	src = writeSourceDir(t, srcDir, "first.hls", map[string]string{"master.m3u8": "first", "0.ts": "segment"})
+	if err := backend.PutDir(src, "video.hls", "alice"); err != nil {
+		t.Errorf("%s: PutDir failed: %s", name, err)
+	}
+	expectConsumed(t, backend, src)
+	expectOwner(t, backend, "video.hls", "alice")
+	expectData(t, backend, "video.hls/master.m3u8", "first")
+	expectData(t, backend, "video.hls/0.ts", "segment")
+
+	src = writeSourceDir(t, srcDir, "second.hls", map[string]string{"master.m3u8": "second"})
+	if err := backend.PutDir(src, "video.hls", "alice"); err != nil {
+		t.Errorf("%s: Replacing with PutDir failed: %s", name, err)
+	}
+	expectData(t, backend, "video.hls/master.m3u8", "second")
+	if _, err := backend.Read("video.hls/0.ts"); !IsNotExist(err) {
+		t.Errorf("%s: Expected the files of the replaced directory to be removed, got %v", name, err)
+	}
+
+	// Deleting
+	if err := backend.Delete("video.mp4", "bob"); !IsPermissionDenied(err) {
+		t.Errorf("%s: Expected deleting a file of another user to be denied, got %v", name, err)
+	}
+	expectData(t, backend, "video.mp4", "second")
+
+	if err := backend.Delete("video.mp4", "alice"); err != nil {
+		t.Errorf("%s: Delete failed: %s", name, err)
+	}
+	if _, err := backend.Owner("video.mp4"); !IsNotExist(err) {
+		t.Errorf("%s: Expected a deleted file to not exist, got %v", name, err)
+	}
+	if err := backend.Delete("video.mp4", "alice"); !IsNotExist(err) {
+		t.Errorf("%s: Expected deleting a missing file to fail as not existing, got %v", name, err)
+	}
+
+	if err := backend.DeleteAny("video.hls"); err != nil {
+		t.Errorf("%s: DeleteAny failed: %s", name, err)
+	}
+	if _, err := backend.Read("video.hls/master.m3u8"); !IsNotExist(err) {
+		t.Errorf("%s: Expected the files of a deleted directory to not exist, got %v", name, err)
+	}
+	if err := backend.DeleteAny("video.hls"); !IsNotExist(err) {
+		t.Errorf("%s: Expected deleting a missing directory to fail as not existing, got %v", name, err)
+	}
+
+	// A deleted name can be reserved again
+	if err := backend.Reserve("video.mp4", "bob"); err != nil {
+		t.Errorf("%s: Reserving a deleted name failed: %s", name, err)
+	}
+
+	if url := backend.URL("video.mp4"); url != baseUrl+"/video.mp4" {
+		t.Errorf("%s: URL %s, expected %s/video.mp4", name, url, baseUrl)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storagetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testBackend(t, NewMemory("http://example.com/memory"), dir, "http://example.com/memory")
+}
+
+func TestLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storagetest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The stored files are renamed so both need to be in the same mount
+	root := path.Join(dir, "serve")
+	srcDir := path.Join(dir, "temp")
+	for _, subdir := range []string{root, srcDir} {
+		err = os.Mkdir(subdir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backend := NewLocal(ownedfile.NewCollection(), root, "http://example.com/local")
+	testBackend(t, backend, srcDir, "http://example.com/local")
+
+	// Stored directories don't leave the replaced one behind
+	files, err := ioutil.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if file.Name() != "video.mp4.owner" {
+			t.Errorf("Unexpected file %s left in the storage", file.Name())
+		}
+	}
+}
+
+func TestContentTypeOf(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+	}{
+		{"video.mp4", "video/mp4"},
+		{"video.jpg", "image/jpeg"},
+		{"video.320w.webp", "image/webp"},
+		{"video.sprites.vtt", "text/vtt"},
+		{"video.version.json", "application/json"},
+		{"video.hls/master.m3u8", "application/vnd.apple.mpegurl"},
+		{"video.hls/720p0.ts", "video/mp2t"},
+		{"video.dash/manifest.mpd", "application/dash+xml"},
+		{"video.dash/chunk-stream0-00001.m4s", "video/iso.segment"},
+		{"video.unknown", "application/octet-stream"},
+		{"video", "application/octet-stream"},
+	}
+
+	for i, test := range tests {
+		if contentType := ContentTypeOf(test.name); contentType != test.contentType {
+			t.Errorf("%d %s: content type %s, expected %s", i, test.name, contentType, test.contentType)
+		}
+	}
+}
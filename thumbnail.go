@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+
+	"./jobstatus"
+	"./storage"
+	"./transcode"
+
+	"github.com/gorilla/mux"
+)
+
+// Choosing the thumbnail of a processed video, either a frame of the video at
+// a given time or an image uploaded by the client.
+
+// Maximum size of an uploaded thumbnail in bytes
+const maxThumbnailSize = 10 * 1024 * 1024
+
+// Maximum width and height of an uploaded thumbnail in pixels, the decoded
+// image takes 4 bytes per pixel
+const maxThumbnailDimension = 4096
+
+// Quality of the re-encoded uploaded thumbnails
+const thumbnailJpegQuality = 90
+
+// Returns the path or URL the served file `name` can be read from by the
+// transcoder, local files are read directly
+func servedFileSource(name string) string {
+	if backend.Name() == "local" {
+		return path.Join(serveBase, name)
+	}
+	return backend.URL(name)
+}
+
+// Name of the served thumbnail of the video `token` resized to `width` pixels
+func thumbnailVariantName(token string, width int, format transcode.ImageFormat) string {
+	return fmt.Sprintf("%s.%dw.%s", token, width, format.Extension())
+}
+
+// Names of the resized thumbnails of the video `token` in every format that may
+// be served, including the ones the current encoder can't produce
+func thumbnailVariantNames(token string) []string {
+	names := []string{}
+	for _, width := range thumbnailWidths {
+		for _, format := range transcode.ThumbnailFormats {
+			names = append(names, thumbnailVariantName(token, width, format))
+		}
+	}
+	return names
+}
+
+// Resized thumbnails of the video to generate to the temp directory
+func thumbnailVariants(video *videoToTranscode) []transcode.ThumbnailVariant {
+	variants := []transcode.ThumbnailVariant{}
+	for _, width := range thumbnailWidths {
+		for _, format := range thumbnailFormats {
+			variants = append(variants, transcode.ThumbnailVariant{
+				Width:  width,
+				Format: format,
+				Path:   path.Join(tempBase, thumbnailVariantName(video.token, width, format)),
+			})
+		}
+	}
+	return variants
+}
+
+// URLs of the resized thumbnails of `version` of the video `token` by format
+// and `srcset` width descriptor, eg. "webp" -> "320w" -> URL. Nil if disabled.
+func thumbnailUrls(token string, version int) map[string]map[string]string {
+	if len(thumbnailWidths) == 0 {
+		return nil
+	}
+
+	urls := map[string]map[string]string{}
+	for _, format := range thumbnailFormats {
+		urls[string(format)] = map[string]string{}
+		for _, width := range thumbnailWidths {
+			url := backend.URL(thumbnailVariantName(token, width, format))
+			urls[string(format)][fmt.Sprintf("%dw", width)] = versionedUrl(url, version)
+		}
+	}
+	return urls
+}
+
+// Resize the thumbnail at `video.thumbDstPath` to `thumbnailWidths` next to it
+// in the temp directory. Every format is resized separately and the ones that
+// fail are skipped, only cancelling `ctx` fails the resizing.
+func resizeThumbnail(ctx context.Context, video *videoToTranscode) error {
+	variants := thumbnailVariants(video)
+
+	for _, format := range thumbnailFormats {
+		formatVariants := []transcode.ThumbnailVariant{}
+		for _, variant := range variants {
+			if variant.Format == format {
+				formatVariants = append(formatVariants, variant)
+			}
+		}
+
+		err := transcode.ResizeThumbnailContext(ctx, video.thumbDstPath, formatVariants)
+		if err == nil {
+			continue
+		}
+		for _, variant := range formatVariants {
+			_ = os.Remove(variant.Path)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		logError(err, video.thumbDstPath, fmt.Sprintf("Resize thumbnail to %s", format))
+	}
+	return nil
+}
+
+// Move the resized thumbnails that were produced and then the thumbnail itself
+// to the storage
+func storeThumbnail(video *videoToTranscode) error {
+	for _, variant := range thumbnailVariants(video) {
+		if _, err := os.Stat(variant.Path); os.IsNotExist(err) {
+			continue
+		}
+
+		name := path.Base(variant.Path)
+		err := backend.Put(variant.Path, name, variant.Format.ContentType(), video.owner)
+		if err != nil {
+			return err
+		}
+	}
+
+	return backend.Put(video.thumbDstPath, video.thumbName, "image/jpeg", video.owner)
+}
+
+// Resize the thumbnail at `video.thumbDstPath` and move all of them to the storage
+func putThumbnail(ctx context.Context, video *videoToTranscode) error {
+	err := resizeThumbnail(ctx, video)
+	if err != nil {
+		return err
+	}
+	return storeThumbnail(video)
+}
+
+// Decode the uploaded JPEG or PNG image from `r` and write it to `dst` as JPEG,
+// re-encoding drops any metadata and anything that is not a plain image.
+// Returns the HTTP status to respond with if the image is not acceptable.
+func reencodeThumbnail(r io.Reader, dst string) (int, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxThumbnailSize+1))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if len(data) > maxThumbnailSize {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("The thumbnail must be at most %d bytes", maxThumbnailSize)
+	}
+
+	// Check the dimensions before decoding the whole image
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || (format != "jpeg" && format != "png") {
+		return http.StatusUnsupportedMediaType, errors.New("The thumbnail must be a JPEG or PNG image")
+	}
+	if config.Width <= 0 || config.Height <= 0 ||
+		config.Width > maxThumbnailDimension || config.Height > maxThumbnailDimension {
+		return http.StatusUnprocessableEntity, fmt.Errorf("The thumbnail must be at most %dx%d pixels",
+			maxThumbnailDimension, maxThumbnailDimension)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return http.StatusUnprocessableEntity, errors.New("The thumbnail image is corrupted")
+	}
+
+	file, err := os.Create(dst)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	err = jpeg.Encode(file, img, &jpeg.Options{Quality: thumbnailJpegQuality})
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// Generate the thumbnail of `video` at `time` seconds of the served video to
+// `video.thumbDstPath`. The retained source is used if available since it's
+// of better quality, `time` is then mapped through the edit list.
+func generateThumbnailAt(ctx context.Context, video *videoToTranscode, retained bool, time float64) error {
+	src := servedFileSource(video.videoName)
+	options := transcode.Options{Quality: transcode.QualityHigh}
+
+	if retained {
+		src = video.keepPath
+		options.CompensateRotation = video.rotation
+		options.Flip = videoFlip(video)
+		time = video.trim.SourceTime(time, video.duration)
+	}
+
+	err := transcode.GenerateThumbnailContext(ctx, src, video.thumbDstPath, time, &options)
+	if err != nil {
+		return err
+	}
+
+	// The encoder succeeds without output if the time is past the end
+	_, err = os.Stat(video.thumbDstPath)
+	return err
+}
+
+// > PUT /uploads/:token/thumbnail
+// Replaces the thumbnail of the video with either:
+// - The frame at `time` seconds of the video as a query parameter
+// - A JPEG or PNG image in the body with the matching Content-Type
+// The user must own the video, or use the master secret.
+func thumbnailHandler(w http.ResponseWriter, r *http.Request, user string, admin bool) (int, error) {
+
+	vars := mux.Vars(r)
+	token := vars["token"]
+
+	// Check the ownership before doing anything
+	thumbName := token + ".jpg"
+	owner, err := backend.Owner(thumbName)
+	if storage.IsNotExist(err) {
+		return http.StatusNotFound, errors.New("Video not found")
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !admin && owner != user {
+		return http.StatusForbidden, errors.New("Video is owned by another user")
+	}
+
+	// Use the settings of the retained source if there is one
+	video, _, err := loadRetainedVideo(token, owner, admin)
+	retained := err == nil
+	if !retained {
+		video = createVideoToTranscode(token, nil, owner)
+	}
+
+	// The stored version outlives the retained source
+	storedVersion, err := readServedVersion(token)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if storedVersion > video.servedVersion {
+		video.version = storedVersion
+		video.servedVersion = storedVersion
+	}
+	video.thumbDstPath = path.Join(tempBase, token+".thumb.jpg")
+
+	// The processing would overwrite the thumbnail
+	if !activateIdleVideo(video) {
+		return http.StatusConflict, errors.New("The video is still being processed")
+	}
+	defer deactivateVideo(video)
+	defer os.Remove(video.thumbDstPath)
+
+	video.processing.Lock()
+	defer video.processing.Unlock()
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "image/jpeg" || contentType == "image/png" {
+		log.Printf("%s: Receiving custom thumbnail", token)
+
+		status, err := reencodeThumbnail(r.Body, video.thumbDstPath)
+		if err != nil {
+			return status, err
+		}
+
+		video.thumbnailTime = nil
+		video.customThumbnail = true
+	} else {
+		time, err := strconv.ParseFloat(r.URL.Query().Get("time"), 64)
+		if err != nil || time < 0.0 {
+			return http.StatusBadRequest, errors.New("Expected a JPEG or PNG image or a non-negative thumbnail time")
+		}
+
+		duration := video.trim.Duration(video.duration)
+		if retained && duration > 0.0 && time >= duration {
+			return http.StatusUnprocessableEntity, fmt.Errorf("Thumbnail time is past the end of the %g second video", duration)
+		}
+
+		log.Printf("%s: Generating thumbnail at %.2f seconds", token, time)
+
+		ctx, cancel := requestTranscodeContext(video, r)
+		defer cancel()
+
+		err = generateThumbnailAt(ctx, video, retained, time)
+		if err != nil && video.ctx.Err() != nil {
+			return http.StatusNotFound, errors.New("Video not found")
+		} else if err != nil {
+			logError(err, token, "Generate thumbnail")
+			return http.StatusUnprocessableEntity, errors.New("Could not generate a thumbnail at the time")
+		}
+
+		if duration > 0.0 {
+			relativeTime := time / duration
+			video.thumbnailTime = &relativeTime
+		}
+		video.customThumbnail = false
+	}
+
+	// Don't resurrect the files of a deleted video
+	if video.ctx.Err() != nil {
+		return http.StatusNotFound, errors.New("Video not found")
+	}
+
+	// Replace the served thumbnails, this checks the ownership again
+	ctx, cancel := requestTranscodeContext(video, r)
+	defer cancel()
+
+	err = reserveNewOutputs(video)
+	if err == nil {
+		err = putThumbnail(ctx, video)
+	}
+	if err != nil {
+		if storage.IsPermissionDenied(err) {
+			return http.StatusForbidden, err
+		}
+		return http.StatusInternalServerError, err
+	}
+
+	// The new version makes the clients skip the cached thumbnail
+	video.servedVersion++
+	video.version = video.servedVersion
+	jobs.SetOutputs(token, videoOutputs(video))
+
+	err = storeServedVersion(video)
+	logError(err, token, "Store served version")
+
+	// Keep the choice and the version if the video is re-edited later
+	if retained {
+		err = writeManifestFile(video, jobstatus.StateDone, video.keepManifestPath)
+		logError(err, video.keepManifestPath, "Write retained manifest")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(struct {
+		Thumbnail  string                       `json:"thumbnail"`
+		Thumbnails map[string]map[string]string `json:"thumbnails,omitempty"`
+	}{
+		versionedUrl(video.thumbUrl, video.servedVersion),
+		thumbnailUrls(video.token, video.servedVersion),
+	})
+	if err != nil {
+		log.Printf("Failed to send response: %s", err.Error())
+	}
+
+	return http.StatusOK, nil
+}
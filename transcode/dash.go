@@ -0,0 +1,101 @@
+package transcode
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+)
+
+// Length of a single DASH segment in seconds
+const dashSegmentTime = 4
+
+// Synchronously transcode a video from `src` to MPEG-DASH in the directory
+// `dstDir`. Every rendition not larger than the source becomes a video
+// representation with fragmented MP4 segments, described by `manifest.mpd`.
+// All the renditions share a single audio representation.
+func TranscodeDASH(src string, dstDir string, renditions []Rendition, options *Options, trimOptions *TrimOptions) error {
+	return TranscodeDASHContext(context.Background(), src, dstDir, renditions, options, trimOptions)
+}
+
+// Like `TranscodeDASH` but kills the encoder if `ctx` is cancelled or expires
+func TranscodeDASHContext(ctx context.Context, src string, dstDir string, renditions []Rendition, options *Options, trimOptions *TrimOptions) error {
+
+	// Concatenate the ranges first if there are several
+	src, options, trimOptions, cleanup, err := editedSource(ctx, src, dstDir, options, trimOptions)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	_, height, err := displayResolution(src, options)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dstDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	selected := selectRenditions(renditions, height)
+
+	// Input file
+	args := inputArgs(src, trimOptions)
+
+	// Overwrite
+	args = append(args, "-y")
+
+	// Every rendition is a separate output stream of the same input video
+	audioBitrate := 0
+	for _, rendition := range selected {
+		args = append(args, "-map", "0:v:0")
+		if rendition.AudioBitrate > audioBitrate {
+			audioBitrate = rendition.AudioBitrate
+		}
+	}
+
+	// The video may not have an audio track
+	args = append(args, "-map", "0:a:0?")
+
+	// Convert video: h264, keyframes at the segment boundaries
+	args = append(args, "-c:v", "h264")
+	args = appendSegmentKeyframes(args, dashSegmentTime, options)
+
+	args = append(args,
+		// Convert audio: aac, the encoder is marked experimental in libav
+		"-c:a", "aac",
+		"-strict", "experimental",
+		"-b:a", fmt.Sprintf("%dk", audioBitrate),
+	)
+
+	// Per stream options: scaling, rotation and bitrate
+	for i, rendition := range selected {
+		renditionOptions := Options{}
+		if options != nil {
+			renditionOptions = *options
+		}
+		renditionOptions.Height = rendition.Height
+
+		args = append(args,
+			fmt.Sprintf("-filter:v:%d", i), videoFilter(&renditionOptions),
+			fmt.Sprintf("-b:v:%d", i), fmt.Sprintf("%dk", rendition.VideoBitrate),
+			fmt.Sprintf("-maxrate:v:%d", i), fmt.Sprintf("%dk", rendition.VideoBitrate),
+			fmt.Sprintf("-bufsize:v:%d", i), fmt.Sprintf("%dk", rendition.VideoBitrate*2))
+	}
+	args = appendClearRotation(args)
+
+	// Trimming options
+	args = appendTrimOptions(args, trimOptions)
+
+	// DASH output, the segment duration argument differs between the tools
+	args = append(args, "-f", "dash")
+	args = append(args, current.DashArgs(dashSegmentTime)...)
+	args = append(args,
+		"-use_template", "1",
+		"-use_timeline", "1",
+		path.Join(dstDir, "manifest.mpd"))
+
+	// Call the encoder to do the transcoding
+	return runEncoder(ctx, args, 0.0, nil)
+}
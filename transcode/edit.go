@@ -0,0 +1,183 @@
+package transcode
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Start and end of the range in seconds, the end is `duration` if the range
+// is open or goes past the end of the video. `duration` is 0 if not known.
+func (trimRange TrimRange) seconds(duration float64) (float64, float64) {
+	start, end := 0.0, duration
+	if trimRange.Start != nil {
+		start = float64(*trimRange.Start) / 1000.0
+	}
+	if trimRange.End != nil {
+		rangeEnd := float64(*trimRange.End) / 1000.0
+		if duration <= 0.0 || rangeEnd < duration {
+			end = rangeEnd
+		}
+	}
+	return start, end
+}
+
+// Length of the edited video in seconds when the source is `duration` seconds
+// long, 0 if not known
+func (trimOptions *TrimOptions) Duration(duration float64) float64 {
+	if trimOptions == nil || len(trimOptions.Ranges) == 0 {
+		return duration
+	}
+
+	total := 0.0
+	for _, trimRange := range trimOptions.Ranges {
+		start, end := trimRange.seconds(duration)
+		if end <= 0.0 {
+			return 0.0
+		}
+		if end > start {
+			total += end - start
+		}
+	}
+	return total
+}
+
+// Maps `time` seconds in the edited video to the time in the source video
+// that is `duration` seconds long
+func (trimOptions *TrimOptions) SourceTime(time float64, duration float64) float64 {
+	if trimOptions == nil || len(trimOptions.Ranges) == 0 {
+		return time
+	}
+
+	for i, trimRange := range trimOptions.Ranges {
+		start, end := trimRange.seconds(duration)
+		length := end - start
+		if time < length || end <= 0.0 || i == len(trimOptions.Ranges)-1 {
+			if end > 0.0 && time > length {
+				time = length
+			}
+			return start + time
+		}
+		time -= length
+	}
+
+	return time
+}
+
+// Synchronously cut the ranges of `trimOptions` from the video `src` and
+// concatenate them into a single continuous video `dst`. The rotation is
+// compensated with `options.CompensateRotation` and `options.Flip` and the
+// video is encoded using `options.Quality`, other options are ignored.
+// Every range is encoded into an MPEG-TS segment first since both tools can
+// join them with the `concat` protocol without encoding again.
+func Edit(src string, dst string, trimOptions *TrimOptions, options *Options) error {
+	return EditContext(context.Background(), src, dst, trimOptions, options)
+}
+
+// Like `Edit` but kills the encoder if `ctx` is cancelled or expires
+func EditContext(ctx context.Context, src string, dst string, trimOptions *TrimOptions, options *Options) error {
+	segmentOptions := Options{}
+	if options != nil {
+		segmentOptions.CompensateRotation = options.CompensateRotation
+		segmentOptions.Flip = options.Flip
+		segmentOptions.Quality = options.Quality
+	}
+
+	segmentPaths := []string{}
+	defer func() {
+		for _, segmentPath := range segmentPaths {
+			_ = os.Remove(segmentPath)
+		}
+	}()
+
+	for i, trimRange := range trimOptions.Ranges {
+		segmentPath := fmt.Sprintf("%s.%d.ts", dst, i)
+		segmentPaths = append(segmentPaths, segmentPath)
+		rangeOptions := &TrimOptions{Ranges: []TrimRange{trimRange}}
+
+		// Input file
+		args := inputArgs(src, rangeOptions)
+
+		args = append(args,
+			// Overwrite
+			"-y",
+
+			// Convert video: h264
+			"-c:v", "h264",
+
+			// Convert audio: aac with the same format for every segment so
+			// they can be joined, the encoder is marked experimental in libav
+			"-c:a", "aac",
+			"-strict", "experimental",
+			"-b:a", "192k",
+			"-ar", "44100",
+			"-ac", "2",
+		)
+
+		// Options
+		args = appendOptions(args, &segmentOptions)
+		args = appendClearRotation(args)
+
+		// Trimming options
+		args = appendTrimOptions(args, rangeOptions)
+
+		// Output segment
+		args = append(args, "-f", "mpegts", segmentPath)
+
+		err := runEncoder(ctx, args, 0.0, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Join the segments without encoding
+	args := inputArgs("concat:"+strings.Join(segmentPaths, "|"), nil)
+
+	args = append(args,
+		// Overwrite
+		"-y",
+
+		// Copy the streams, the ADTS headers of MPEG-TS audio are not
+		// allowed in MP4
+		"-c", "copy",
+		"-bsf:a", "aac_adtstoasc",
+	)
+
+	// The rotation and flip are already compensated
+	args = appendClearRotation(args)
+
+	// Output file
+	args = append(args, dst)
+
+	return runEncoder(ctx, args, 0.0, nil)
+}
+
+// Concatenates the ranges of `trimOptions` into a temporary file next to `dst`
+// if there are several of them. Returns the source to transcode with the
+// options and trimming to use with it, and a function to remove the file.
+func editedSource(ctx context.Context, src string, dst string, options *Options, trimOptions *TrimOptions) (string, *Options, *TrimOptions, func(), error) {
+	if trimOptions == nil || len(trimOptions.Ranges) <= 1 {
+		return src, options, trimOptions, func() {}, nil
+	}
+
+	editPath := dst + ".edit.mp4"
+	cleanup := func() {
+		_ = os.Remove(editPath)
+	}
+
+	err := EditContext(ctx, src, editPath, trimOptions, options)
+	if err != nil {
+		cleanup()
+		return "", nil, nil, nil, err
+	}
+
+	editOptions := Options{}
+	if options != nil {
+		editOptions = *options
+	}
+	editOptions.CompensateRotation = 0
+	editOptions.Flip = FlipNone
+
+	return editPath, &editOptions, nil, cleanup, nil
+}
@@ -0,0 +1,74 @@
+package transcode
+
+import (
+	"math"
+	"testing"
+)
+
+// Pointer to a time in milliseconds for `TrimRange`
+func ms(value int) *int {
+	return &value
+}
+
+func TestTrimDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		trim     *TrimOptions
+		duration float64
+		expected float64
+	}{
+		{"no trimming", nil, 10.0, 10.0},
+		{"no ranges", &TrimOptions{}, 10.0, 10.0},
+		{"open start", &TrimOptions{Ranges: []TrimRange{{End: ms(3000)}}}, 10.0, 3.0},
+		{"open end", &TrimOptions{Ranges: []TrimRange{{Start: ms(4000)}}}, 10.0, 6.0},
+		{"closed", &TrimOptions{Ranges: []TrimRange{{Start: ms(1000), End: ms(2500)}}}, 10.0, 1.5},
+		{"milliseconds", &TrimOptions{Ranges: []TrimRange{{Start: ms(1), End: ms(1002)}}}, 10.0, 1.001},
+		{"end past the video", &TrimOptions{Ranges: []TrimRange{{Start: ms(8000), End: ms(20000)}}}, 10.0, 2.0},
+		{"start past the video", &TrimOptions{Ranges: []TrimRange{{Start: ms(12000)}}}, 10.0, 0.0},
+		{"start past the end", &TrimOptions{Ranges: []TrimRange{{Start: ms(5000), End: ms(3000)}}}, 10.0, 0.0},
+		{"several ranges", &TrimOptions{Ranges: []TrimRange{
+			{End: ms(1000)}, {Start: ms(2000), End: ms(3500)}, {Start: ms(9000)},
+		}}, 10.0, 3.5},
+		{"unknown duration", &TrimOptions{Ranges: []TrimRange{{Start: ms(1000), End: ms(3000)}}}, 0.0, 2.0},
+		{"unknown duration open end", &TrimOptions{Ranges: []TrimRange{{Start: ms(1000)}}}, 0.0, 0.0},
+	}
+
+	for i, test := range tests {
+		duration := test.trim.Duration(test.duration)
+		if math.Abs(duration-test.expected) > 1e-9 {
+			t.Errorf("%d %s: duration %g, expected %g", i, test.name, duration, test.expected)
+		}
+	}
+}
+
+func TestTrimSourceTime(t *testing.T) {
+	single := &TrimOptions{Ranges: []TrimRange{{Start: ms(2000), End: ms(4000)}}}
+	several := &TrimOptions{Ranges: []TrimRange{{End: ms(1000)}, {Start: ms(5000), End: ms(6000)}}}
+
+	tests := []struct {
+		name     string
+		trim     *TrimOptions
+		time     float64
+		duration float64
+		expected float64
+	}{
+		{"no trimming", nil, 3.0, 10.0, 3.0},
+		{"open end", &TrimOptions{Ranges: []TrimRange{{Start: ms(2000)}}}, 1.5, 10.0, 3.5},
+		{"open start", &TrimOptions{Ranges: []TrimRange{{End: ms(4000)}}}, 1.5, 10.0, 1.5},
+		{"milliseconds", &TrimOptions{Ranges: []TrimRange{{Start: ms(1)}}}, 0.5, 10.0, 0.501},
+		{"single range", single, 1.0, 10.0, 3.0},
+		{"past the end", single, 5.0, 10.0, 4.0},
+		{"first range", several, 0.5, 10.0, 0.5},
+		{"start of the second range", several, 1.0, 10.0, 5.0},
+		{"second range", several, 1.25, 10.0, 5.25},
+		{"past the last range", several, 10.0, 10.0, 6.0},
+		{"unknown duration", &TrimOptions{Ranges: []TrimRange{{Start: ms(2000)}}}, 3.0, 0.0, 5.0},
+	}
+
+	for i, test := range tests {
+		time := test.trim.SourceTime(test.time, test.duration)
+		if math.Abs(time-test.expected) > 1e-9 {
+			t.Errorf("%d %s: source time %g, expected %g", i, test.name, time, test.expected)
+		}
+	}
+}
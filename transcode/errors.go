@@ -0,0 +1,129 @@
+package transcode
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Classification of a failed transcoder run
+type FailureKind string
+
+const (
+	// The failure didn't match any known pattern, see `TranscodeError.Stderr`
+	FailureUnknown FailureKind = "unknown"
+
+	// The video or audio is in a format the transcoder can't decode or encode
+	FailureUnsupportedCodec FailureKind = "unsupported-codec"
+
+	// The file is corrupted, truncated or not a media file at all
+	FailureInvalidData FailureKind = "invalid-data"
+
+	// The file doesn't contain a video stream to transcode
+	FailureNoVideoStream FailureKind = "no-video-stream"
+
+	// The output could not be written because the disk is full
+	FailureDiskFull FailureKind = "disk-full"
+)
+
+// Human readable descriptions of the failure kinds
+var failureDescriptions = map[FailureKind]string{
+	FailureUnknown:          "Transcoding failed",
+	FailureUnsupportedCodec: "Unsupported codec",
+	FailureInvalidData:      "Invalid video data",
+	FailureNoVideoStream:    "No video stream",
+	FailureDiskFull:         "Disk full",
+}
+
+// Patterns of the transcoders' error messages in the order they are checked,
+// a full disk or missing stream often causes other errors as well
+var failurePatterns = []struct {
+	kind  FailureKind
+	regex *regexp.Regexp
+}{
+	{FailureDiskFull, regexp.MustCompile("(?i)no space left on device")},
+	{FailureNoVideoStream, regexp.MustCompile("(?i)matches no streams|does not contain any stream|no video stream")},
+	{FailureUnsupportedCodec, regexp.MustCompile("(?i)(decoder|encoder) \\(?.*\\)? ?not found|unknown (decoder|encoder)|unsupported codec|codec not currently supported|could not find codec parameters")},
+	{FailureInvalidData, regexp.MustCompile("(?i)invalid data found|moov atom not found|error while decoding|corrupt|end of file|invalid nal")},
+}
+
+// Amount of the transcoder's stderr output kept for the error
+const stderrTailSize = 8 * 1024
+
+// Error of a failed transcoder run with the end of its error output
+type TranscodeError struct {
+
+	// Classification of the failure
+	Kind FailureKind
+
+	// The line of the output that the classification is based on, or the last
+	// line if the failure is unknown
+	Message string
+
+	// At most the last 8kB of the output of the transcoder
+	Stderr string
+
+	// The original error, usually an `*exec.ExitError`
+	Err error
+}
+
+func (self *TranscodeError) Error() string {
+	description := failureDescriptions[self.Kind]
+	if self.Message == "" {
+		return fmt.Sprintf("%s: %s", description, self.Err.Error())
+	}
+	return fmt.Sprintf("%s: %s", description, self.Message)
+}
+
+// Classification of the error, also used by the job status
+func (self *TranscodeError) ErrorKind() string {
+	return string(self.Kind)
+}
+
+// Writer that keeps only the last `limit` bytes written to it
+type tailBuffer struct {
+	limit int
+	data  []byte
+}
+
+func (self *tailBuffer) Write(p []byte) (int, error) {
+	self.data = append(self.data, p...)
+	if len(self.data) > self.limit {
+		self.data = self.data[len(self.data)-self.limit:]
+	}
+	return len(p), nil
+}
+
+func (self *tailBuffer) String() string {
+	return string(self.data)
+}
+
+// Returns true if `line` is a progress statistics line, see `parseProgressLine`
+func isStatsLine(line string) bool {
+	return strings.Contains(line, "frame=") && strings.Contains(line, "time=")
+}
+
+// Creates a classified error from the error of a transcoder run and its output
+func classifyFailure(err error, stderr string) *TranscodeError {
+	lines := []string{}
+	for _, line := range strings.FieldsFunc(stderr, func(r rune) bool { return r == '\r' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line != "" && !isStatsLine(line) {
+			lines = append(lines, line)
+		}
+	}
+
+	for _, pattern := range failurePatterns {
+		for _, line := range lines {
+			if pattern.regex.MatchString(line) {
+				return &TranscodeError{Kind: pattern.kind, Message: line, Stderr: stderr, Err: err}
+			}
+		}
+	}
+
+	message := ""
+	if len(lines) > 0 {
+		message = lines[len(lines)-1]
+	}
+	return &TranscodeError{Kind: FailureUnknown, Message: message, Stderr: stderr, Err: err}
+}
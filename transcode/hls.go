@@ -0,0 +1,104 @@
+package transcode
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// Length of a single HLS segment in seconds
+const hlsSegmentTime = 6
+
+// Synchronously transcode a video from `src` to HLS segments in the directory
+// `dstDir`. Every rendition not larger than the source is written as
+// `$name.m3u8` with its segments and the renditions are listed in `master.m3u8`.
+// `options.Height` and `options.Bitrate` are overridden by the renditions.
+func TranscodeHLS(src string, dstDir string, renditions []Rendition, options *Options, trimOptions *TrimOptions) error {
+	return TranscodeHLSContext(context.Background(), src, dstDir, renditions, options, trimOptions)
+}
+
+// Like `TranscodeHLS` but kills the encoder if `ctx` is cancelled or expires
+func TranscodeHLSContext(ctx context.Context, src string, dstDir string, renditions []Rendition, options *Options, trimOptions *TrimOptions) error {
+
+	// Concatenate the ranges first if there are several
+	src, options, trimOptions, cleanup, err := editedSource(ctx, src, dstDir, options, trimOptions)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	width, height, err := displayResolution(src, options)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dstDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	var master bytes.Buffer
+	master.WriteString("#EXTM3U\n")
+	master.WriteString("#EXT-X-VERSION:3\n")
+
+	for _, rendition := range selectRenditions(renditions, height) {
+		renditionOptions := Options{}
+		if options != nil {
+			renditionOptions = *options
+		}
+		renditionOptions.Height = rendition.Height
+		renditionOptions.Bitrate = rendition.VideoBitrate
+
+		// Input file
+		args := inputArgs(src, trimOptions)
+
+		args = append(args,
+			// Overwrite
+			"-y",
+
+			// Convert video: h264
+			"-c:v", "h264",
+		)
+
+		// Keyframes at the segment boundaries
+		args = appendSegmentKeyframes(args, hlsSegmentTime, options)
+
+		args = append(args,
+			// Convert audio: aac, the encoder is marked experimental in libav
+			"-c:a", "aac",
+			"-strict", "experimental",
+			"-b:a", fmt.Sprintf("%dk", rendition.AudioBitrate),
+		)
+
+		// Options
+		args = appendOptions(args, &renditionOptions)
+		args = appendClearRotation(args)
+
+		// Trimming options
+		args = appendTrimOptions(args, trimOptions)
+
+		// HLS output
+		args = append(args,
+			"-f", "hls",
+			"-hls_time", fmt.Sprintf("%d", hlsSegmentTime),
+			"-hls_list_size", "0",
+			path.Join(dstDir, rendition.Name()+".m3u8"))
+
+		// Call the encoder to do the transcoding
+		err = runEncoder(ctx, args, 0.0, nil)
+		if err != nil {
+			return err
+		}
+
+		bandwidth := (rendition.VideoBitrate + rendition.AudioBitrate) * 1000
+		fmt.Fprintf(&master, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d\n",
+			bandwidth, renditionWidth(rendition, width, height), rendition.Height)
+		fmt.Fprintf(&master, "%s.m3u8\n", rendition.Name())
+	}
+
+	// Write the master playlist last so it only exists if everything succeeded
+	return ioutil.WriteFile(path.Join(dstDir, "master.m3u8"), master.Bytes(), 0644)
+}
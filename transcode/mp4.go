@@ -0,0 +1,372 @@
+package transcode
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"time"
+)
+
+// Minimal ISO base media file format (MP4/MOV) reader, only the boxes needed
+// for the metadata are parsed:
+//
+//   moov/mvhd: Duration, timescale and creation time
+//   moov/trak/tkhd: Dimensions and the transformation matrix (rotation)
+//   moov/trak/mdia/hdlr: Whether the track is video or audio
+//   moov/trak/mdia/minf/stbl/stsd: Codec of the track
+
+// The movie box is read to memory, refuse anything unreasonably large
+const maxMoovSize = 64 * 1024 * 1024
+
+// Times in MP4 files are seconds since 1904-01-01 00:00:00 UTC
+var mp4Epoch = time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Codec names for the sample entry types, named like the probe names them
+var mp4Codecs = map[string]string{
+	"avc1": "h264",
+	"avc3": "h264",
+	"hvc1": "hevc",
+	"hev1": "hevc",
+	"mp4v": "mpeg4",
+	"s263": "h263",
+	"vp09": "vp9",
+	"av01": "av1",
+	"mp4a": "aac",
+	"ac-3": "ac3",
+	"samr": "amr_nb",
+	"Opus": "opus",
+}
+
+var errNoMoov = errors.New("Did not find the movie box")
+
+// Reads the header of a box from `r`, returns the type and the size of the
+// body, -1 if the box extends to the end of the file
+func readBoxHeader(r io.Reader) (string, int64, error) {
+	var header [8]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return "", 0, err
+	}
+
+	size := int64(binary.BigEndian.Uint32(header[0:4]))
+	boxType := string(header[4:8])
+
+	switch size {
+	case 0:
+		return boxType, -1, nil
+	case 1:
+		var largeSize [8]byte
+		_, err := io.ReadFull(r, largeSize[:])
+		if err != nil {
+			return "", 0, err
+		}
+		size = int64(binary.BigEndian.Uint64(largeSize[:])) - 16
+	default:
+		size -= 8
+	}
+
+	if size < 0 {
+		return "", 0, fmt.Errorf("Malformed %s box", boxType)
+	}
+	return boxType, size, nil
+}
+
+// Calls `fn` for every box in `data`
+func forEachBox(data []byte, fn func(boxType string, body []byte) error) error {
+	for len(data) >= 8 {
+		size := int64(binary.BigEndian.Uint32(data[0:4]))
+		boxType := string(data[4:8])
+		headerSize := int64(8)
+
+		switch size {
+		case 0:
+			size = int64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return fmt.Errorf("Malformed %s box", boxType)
+			}
+			size = int64(binary.BigEndian.Uint64(data[8:16]))
+			headerSize = 16
+		}
+
+		if size < headerSize || size > int64(len(data)) {
+			return fmt.Errorf("Malformed %s box", boxType)
+		}
+
+		err := fn(boxType, data[headerSize:size])
+		if err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// Returns the first child box of type `boxType` in `data`, nil if not found
+func findBox(data []byte, boxType string) []byte {
+	var found []byte
+	_ = forEachBox(data, func(childType string, body []byte) error {
+		if found == nil && childType == boxType {
+			found = body
+		}
+		return nil
+	})
+	return found
+}
+
+// Reads the movie box of the file to memory, it may be before or after the
+// media data depending on whether the file is optimized for streaming
+func readMoov(r io.ReadSeeker) ([]byte, error) {
+	for {
+		boxType, size, err := readBoxHeader(r)
+		if err == io.EOF {
+			return nil, errNoMoov
+		} else if err != nil {
+			return nil, err
+		}
+
+		if boxType == "moov" {
+			// The last box may extend to the end of the file without a size
+			if size < 0 {
+				moov, err := ioutil.ReadAll(io.LimitReader(r, maxMoovSize+1))
+				if err == nil && len(moov) > maxMoovSize {
+					err = fmt.Errorf("Unsupported movie box size %d", len(moov))
+				}
+				return moov, err
+			}
+
+			if size > maxMoovSize {
+				return nil, fmt.Errorf("Unsupported movie box size %d", size)
+			}
+			moov := make([]byte, size)
+			_, err = io.ReadFull(r, moov)
+			return moov, err
+		}
+
+		if size < 0 {
+			return nil, errNoMoov
+		}
+		_, err = r.Seek(size, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Reads the version of a full box and the times that have the same layout in
+// `mvhd` and `tkhd`: creation time, modification time and a 32-bit field.
+// Returns the creation time, the 32-bit field and the rest of the box.
+func readFullBoxTimes(body []byte) (uint64, uint32, []byte, error) {
+	if len(body) < 4 {
+		return 0, 0, nil, errors.New("Truncated box")
+	}
+
+	version := body[0]
+	body = body[4:]
+
+	if version == 1 {
+		if len(body) < 20 {
+			return 0, 0, nil, errors.New("Truncated box")
+		}
+		return binary.BigEndian.Uint64(body[0:8]), binary.BigEndian.Uint32(body[16:20]), body[20:], nil
+	}
+
+	if len(body) < 12 {
+		return 0, 0, nil, errors.New("Truncated box")
+	}
+	return uint64(binary.BigEndian.Uint32(body[0:4])), binary.BigEndian.Uint32(body[8:12]), body[12:], nil
+}
+
+// Reads a duration field following `readFullBoxTimes`
+func readFullBoxDuration(version byte, body []byte) (uint64, []byte, error) {
+	if version == 1 {
+		if len(body) < 8 {
+			return 0, nil, errors.New("Truncated box")
+		}
+		return binary.BigEndian.Uint64(body[0:8]), body[8:], nil
+	}
+
+	if len(body) < 4 {
+		return 0, nil, errors.New("Truncated box")
+	}
+	return uint64(binary.BigEndian.Uint32(body[0:4])), body[4:], nil
+}
+
+func mp4Time(seconds uint64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return mp4Epoch.Add(time.Duration(seconds) * time.Second)
+}
+
+// Parses the movie header: duration in seconds and creation time
+func parseMvhd(body []byte) (float64, time.Time, error) {
+	creation, timescale, rest, err := readFullBoxTimes(body)
+	if err != nil {
+		return 0.0, time.Time{}, err
+	}
+
+	duration, _, err := readFullBoxDuration(body[0], rest)
+	if err != nil {
+		return 0.0, time.Time{}, err
+	}
+
+	if timescale == 0 {
+		return 0.0, mp4Time(creation), nil
+	}
+	return float64(duration) / float64(timescale), mp4Time(creation), nil
+}
+
+// Parses the track header: dimensions and rotation of the track
+func parseTkhd(body []byte) (int, int, int, error) {
+	_, _, rest, err := readFullBoxTimes(body)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	// The track ID is followed by a reserved field before the duration
+	if len(rest) < 4 {
+		return 0, 0, 0, errors.New("Truncated tkhd box")
+	}
+	_, rest, err = readFullBoxDuration(body[0], rest[4:])
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	// reserved[8], layer, alternate group, volume, reserved[2], matrix[36],
+	// width and height as 16.16 fixed point
+	if len(rest) < 60 {
+		return 0, 0, 0, errors.New("Truncated tkhd box")
+	}
+	matrix := rest[16:52]
+	width := int(binary.BigEndian.Uint32(rest[52:56]) >> 16)
+	height := int(binary.BigEndian.Uint32(rest[56:60]) >> 16)
+
+	// The matrix is {a, b, u, c, d, v, x, y, w} with a, b, c, d in 16.16 fixed
+	// point, the rotation is the angle of the transformed x axis
+	a := float64(int32(binary.BigEndian.Uint32(matrix[0:4])))
+	b := float64(int32(binary.BigEndian.Uint32(matrix[4:8])))
+	degrees := int(math.Floor(math.Atan2(b, a)*180.0/math.Pi + 0.5))
+
+	return width, height, normalizeRotation(degrees), nil
+}
+
+// Returns the handler type of the track, eg. "vide" or "soun"
+func parseHdlr(body []byte) string {
+	if len(body) < 12 {
+		return ""
+	}
+	return string(body[8:12])
+}
+
+// Returns the codec name of the first sample entry
+func parseStsd(body []byte) string {
+	if len(body) < 16 {
+		return ""
+	}
+
+	format := string(body[12:16])
+	codec, ok := mp4Codecs[format]
+	if !ok {
+		return format
+	}
+	return codec
+}
+
+// Parses a single track to `info`, tracks that are not video or audio are ignored
+func parseTrak(trak []byte, info *MediaInfo) error {
+	mdia := findBox(trak, "mdia")
+	if mdia == nil {
+		return nil
+	}
+
+	codec := ""
+	if stsd := findBox(findBox(findBox(mdia, "minf"), "stbl"), "stsd"); stsd != nil {
+		codec = parseStsd(stsd)
+	}
+
+	switch parseHdlr(findBox(mdia, "hdlr")) {
+	case "vide":
+		tkhd := findBox(trak, "tkhd")
+		if tkhd == nil {
+			return errors.New("Video track without a tkhd box")
+		}
+
+		width, height, rotation, err := parseTkhd(tkhd)
+		if err != nil {
+			return err
+		}
+
+		info.VideoStreams = append(info.VideoStreams, VideoStream{
+			Codec:    codec,
+			Width:    width,
+			Height:   height,
+			Rotation: rotation,
+		})
+
+	case "soun":
+		info.AudioStreams = append(info.AudioStreams, AudioStream{
+			Codec: codec,
+		})
+	}
+
+	return nil
+}
+
+// Reads the metadata of the MP4 or QuickTime file at `path` without external
+// tools. Only the fields stored in the headers are filled, frame rates and
+// bitrates are left as unknown.
+func ReadMP4Info(path string) (*MediaInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	moov, err := readMoov(file)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &MediaInfo{
+		Container:    "mov,mp4,m4a,3gp,3g2,mj2",
+		VideoStreams: []VideoStream{},
+		AudioStreams: []AudioStream{},
+	}
+
+	mvhd := findBox(moov, "mvhd")
+	if mvhd == nil {
+		return nil, errors.New("Did not find the movie header")
+	}
+	info.Duration, info.CreationTime, err = parseMvhd(mvhd)
+	if err != nil {
+		return nil, err
+	}
+
+	err = forEachBox(moov, func(boxType string, body []byte) error {
+		if boxType != "trak" {
+			return nil
+		}
+		return parseTrak(body, info)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// Reads the metadata of the video at `path`, using the built-in MP4 reader if
+// possible and `Probe` for other formats or if the headers are incomplete
+func Inspect(path string) (*MediaInfo, error) {
+	info, err := ReadMP4Info(path)
+	if err == nil && info.Duration > 0.0 && info.Video() != nil {
+		return info, nil
+	}
+
+	return Probe(path)
+}
@@ -0,0 +1,283 @@
+package transcode
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// Fixtures are crafted box by box so every field the reader depends on is
+// visible in the test
+
+func u16(value uint16) []byte {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, value)
+	return data
+}
+
+func u32(value uint32) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, value)
+	return data
+}
+
+func u64(value uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, value)
+	return data
+}
+
+func concat(parts ...[]byte) []byte {
+	data := []byte{}
+	for _, part := range parts {
+		data = append(data, part...)
+	}
+	return data
+}
+
+// Box with a 32-bit size
+func box(boxType string, children ...[]byte) []byte {
+	body := concat(children...)
+	return concat(u32(uint32(8+len(body))), []byte(boxType), body)
+}
+
+// Box with the 64-bit `largesize` header
+func largeBox(boxType string, children ...[]byte) []byte {
+	body := concat(children...)
+	return concat(u32(1), []byte(boxType), u64(uint64(16+len(body))), body)
+}
+
+// Box that extends to the end of the file
+func openBox(boxType string, children ...[]byte) []byte {
+	return concat(u32(0), []byte(boxType), concat(children...))
+}
+
+// Seconds since the MP4 epoch
+func mp4Seconds(t time.Time) uint64 {
+	return uint64(t.Sub(mp4Epoch) / time.Second)
+}
+
+func mvhd(version byte, created time.Time, timescale uint32, duration uint64) []byte {
+	header := []byte{version, 0, 0, 0}
+	// rate, volume, reserved, matrix, pre-defined and next track ID
+	rest := concat(u32(0x00010000), u16(0x0100), make([]byte, 10), make([]byte, 36), make([]byte, 24), u32(2))
+
+	if version == 1 {
+		return box("mvhd", header, u64(mp4Seconds(created)), u64(0), u32(timescale), u64(duration), rest)
+	}
+	return box("mvhd", header, u32(uint32(mp4Seconds(created))), u32(0), u32(timescale), u32(uint32(duration)), rest)
+}
+
+// Transformation matrix rotating by `degrees`, `a` and `b` of a rotation are
+// cos and sin, the rest of the matrix is left as identity
+func rotationMatrix(degrees float64) []int32 {
+	radians := degrees * math.Pi / 180.0
+	a := int32(math.Round(math.Cos(radians) * 65536.0))
+	b := int32(math.Round(math.Sin(radians) * 65536.0))
+	return []int32{a, b, 0, -b, a, 0, 0, 0, 0x40000000}
+}
+
+func tkhd(version byte, width int, height int, matrix []int32) []byte {
+	header := []byte{version, 0, 0, 1}
+
+	matrixData := []byte{}
+	for _, value := range matrix {
+		matrixData = append(matrixData, u32(uint32(value))...)
+	}
+	// reserved, layer, alternate group, volume, reserved, matrix, width and height
+	rest := concat(make([]byte, 8), u16(0), u16(0), u16(0), u16(0), matrixData,
+		u32(uint32(width)<<16), u32(uint32(height)<<16))
+
+	if version == 1 {
+		return box("tkhd", header, u64(0), u64(0), u32(1), u32(0), u64(1000), rest)
+	}
+	return box("tkhd", header, u32(0), u32(0), u32(1), u32(0), u32(1000), rest)
+}
+
+func hdlr(handler string) []byte {
+	return box("hdlr", u32(0), u32(0), []byte(handler), make([]byte, 12), []byte{0})
+}
+
+func stsd(format string) []byte {
+	return box("stsd", u32(0), u32(1), box(format, make([]byte, 8)))
+}
+
+func trak(tkhdBox []byte, handler string, format string) []byte {
+	return box("trak", tkhdBox,
+		box("mdia", hdlr(handler), box("minf", box("stbl", stsd(format)))))
+}
+
+func ftyp() []byte {
+	return box("ftyp", []byte("isom"), u32(0x200), []byte("isomiso2avc1mp41"))
+}
+
+var fixtureCreated = time.Date(2016, time.August, 26, 12, 0, 0, 0, time.UTC)
+
+// Movie box of a 10 second video with a video and an audio track
+func fixtureMoov(mvhdVersion byte, tkhdVersion byte, matrix []int32) []byte {
+	return box("moov",
+		mvhd(mvhdVersion, fixtureCreated, 1000, 10000),
+		trak(tkhd(tkhdVersion, 1920, 1080, matrix), "vide", "avc1"),
+		trak(tkhd(tkhdVersion, 0, 0, rotationMatrix(0)), "soun", "mp4a"))
+}
+
+// Write `data` to a file in `dir` and return its path
+func writeFixture(t *testing.T, dir string, name string, data []byte) string {
+	filePath := path.Join(dir, name)
+	err := ioutil.WriteFile(filePath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+func TestReadMP4Info(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mp4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mdat := box("mdat", make([]byte, 64))
+
+	tests := []struct {
+		name     string
+		data     []byte
+		rotation int
+	}{
+		{"version 0 headers", concat(ftyp(), fixtureMoov(0, 0, rotationMatrix(0)), mdat), 0},
+		{"version 1 headers", concat(ftyp(), fixtureMoov(1, 1, rotationMatrix(0)), mdat), 0},
+		{"mixed header versions", concat(ftyp(), fixtureMoov(1, 0, rotationMatrix(0)), mdat), 0},
+		{"rotation 90", concat(ftyp(), fixtureMoov(0, 0, rotationMatrix(90)), mdat), 90},
+		{"rotation 180", concat(ftyp(), fixtureMoov(0, 0, rotationMatrix(180)), mdat), 180},
+		{"rotation 270", concat(ftyp(), fixtureMoov(1, 1, rotationMatrix(270)), mdat), 270},
+		{"rotation -90", concat(ftyp(), fixtureMoov(0, 0, rotationMatrix(-90)), mdat), 270},
+		{"non-orthogonal rotation rounded down", concat(ftyp(), fixtureMoov(0, 0, rotationMatrix(30)), mdat), 0},
+		{"non-orthogonal rotation rounded up", concat(ftyp(), fixtureMoov(0, 0, rotationMatrix(60)), mdat), 90},
+		{"scaled matrix", concat(ftyp(), fixtureMoov(0, 0, []int32{0, 2 * 65536, 0, -2 * 65536, 0, 0, 0, 0, 0x40000000}), mdat), 90},
+		{"movie box after media data", concat(ftyp(), mdat, fixtureMoov(0, 0, rotationMatrix(90))), 90},
+		{"largesize media data", concat(ftyp(), largeBox("mdat", make([]byte, 64)), fixtureMoov(0, 0, rotationMatrix(0))), 0},
+		{"largesize movie box", concat(ftyp(), largeBox("moov", fixtureMoov(0, 0, rotationMatrix(0))[8:])), 0},
+		{"movie box to end of file", concat(ftyp(), mdat, openBox("moov", fixtureMoov(0, 0, rotationMatrix(180))[8:])), 180},
+	}
+
+	for i, test := range tests {
+		filePath := writeFixture(t, dir, "valid.mp4", test.data)
+		info, err := ReadMP4Info(filePath)
+		if err != nil {
+			t.Errorf("%d %s: unexpected error: %s", i, test.name, err)
+			continue
+		}
+
+		if info.Duration != 10.0 {
+			t.Errorf("%d %s: duration %g, expected 10", i, test.name, info.Duration)
+		}
+		if !info.CreationTime.Equal(fixtureCreated) {
+			t.Errorf("%d %s: creation time %s, expected %s", i, test.name, info.CreationTime, fixtureCreated)
+		}
+		if len(info.VideoStreams) != 1 || len(info.AudioStreams) != 1 {
+			t.Errorf("%d %s: %d video and %d audio streams, expected 1 and 1", i, test.name,
+				len(info.VideoStreams), len(info.AudioStreams))
+			continue
+		}
+
+		video := info.VideoStreams[0]
+		if video.Codec != "h264" || info.AudioStreams[0].Codec != "aac" {
+			t.Errorf("%d %s: codecs %s and %s, expected h264 and aac", i, test.name, video.Codec, info.AudioStreams[0].Codec)
+		}
+		if video.Width != 1920 || video.Height != 1080 {
+			t.Errorf("%d %s: size %dx%d, expected 1920x1080", i, test.name, video.Width, video.Height)
+		}
+		if video.Rotation != test.rotation {
+			t.Errorf("%d %s: rotation %d, expected %d", i, test.name, video.Rotation, test.rotation)
+		}
+	}
+}
+
+func TestReadMP4InfoMalformed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mp4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	moov := fixtureMoov(0, 0, rotationMatrix(0))
+	truncatedTkhd := tkhd(0, 1920, 1080, rotationMatrix(0))[:40]
+	truncatedTkhd = concat(u32(uint32(len(truncatedTkhd))), truncatedTkhd[4:])
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty file", []byte{}},
+		{"no movie box", concat(ftyp(), box("mdat", make([]byte, 64)))},
+		{"box smaller than its header", concat(ftyp(), u32(4), []byte("free"), moov)},
+		{"largesize smaller than its header", concat(ftyp(), u32(1), []byte("mdat"), u64(8), moov)},
+		{"media data to end of file", concat(ftyp(), openBox("mdat", make([]byte, 64)), moov)},
+		{"movie box larger than the file", concat(ftyp(), u32(uint32(len(moov)+100)), moov[4:])},
+		{"child box larger than its parent", concat(ftyp(), box("moov", u32(1000), []byte("mvhd"), make([]byte, 16)))},
+		{"movie box without a header", concat(ftyp(), box("moov", trak(tkhd(0, 1920, 1080, rotationMatrix(0)), "vide", "avc1")))},
+		{"truncated movie header", concat(ftyp(), box("moov", box("mvhd", []byte{0, 0, 0, 0}, u32(0))))},
+		{"truncated version 1 movie header", concat(ftyp(), box("moov", box("mvhd", []byte{1, 0, 0, 0}, u64(0), u64(0), u32(1000))))},
+		{"truncated track header", concat(ftyp(), box("moov", mvhd(0, fixtureCreated, 1000, 10000),
+			box("trak", truncatedTkhd, box("mdia", hdlr("vide")))))},
+		{"video track without a header", concat(ftyp(), box("moov", mvhd(0, fixtureCreated, 1000, 10000),
+			box("trak", box("mdia", hdlr("vide")))))},
+	}
+
+	for i, test := range tests {
+		filePath := writeFixture(t, dir, "malformed.mp4", test.data)
+		_, err := ReadMP4Info(filePath)
+		if err == nil {
+			t.Errorf("%d %s: expected an error", i, test.name)
+		}
+	}
+}
+
+// Every prefix of a file that ends with the movie box is missing some of it
+func TestReadMP4InfoTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mp4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := concat(ftyp(), box("mdat", make([]byte, 64)), fixtureMoov(1, 1, rotationMatrix(90)))
+
+	for length := 0; length < len(data); length++ {
+		filePath := writeFixture(t, dir, "truncated.mp4", data[:length])
+		_, err := ReadMP4Info(filePath)
+		if err == nil {
+			t.Errorf("Truncated to %d of %d bytes: expected an error", length, len(data))
+		}
+	}
+}
+
+func TestReadMP4InfoMissingFile(t *testing.T) {
+	_, err := ReadMP4Info(path.Join(os.TempDir(), "mp4test-does-not-exist.mp4"))
+	if err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+// Complete MP4 files are read without the external probe
+func TestInspectMP4(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mp4test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filePath := writeFixture(t, dir, "inspect.mp4", concat(ftyp(), fixtureMoov(0, 0, rotationMatrix(270))))
+	info, err := Inspect(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Video() == nil || info.Video().Rotation != 270 {
+		t.Errorf("Expected a video stream with rotation 270, got %+v", info.VideoStreams)
+	}
+}
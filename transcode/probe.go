@@ -0,0 +1,268 @@
+package transcode
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Information about a media file, see `Probe`
+type MediaInfo struct {
+
+	// Names of the container format, eg. "mov,mp4,m4a,3gp,3g2,mj2"
+	Container string
+
+	// Duration in seconds
+	Duration float64
+
+	// Total bitrate in bit/s, 0 if unknown
+	Bitrate int
+
+	// When the video was recorded, zero if unknown
+	CreationTime time.Time
+
+	VideoStreams []VideoStream
+	AudioStreams []AudioStream
+}
+
+// A single video stream of a media file
+type VideoStream struct {
+
+	// Name of the codec, eg. "h264"
+	Codec string
+
+	// Dimensions as stored, rotation is not taken into account
+	Width  int
+	Height int
+
+	// Average frames per second, 0 if unknown
+	FPS float64
+
+	// Bitrate in bit/s, 0 if unknown
+	Bitrate int
+
+	// Clockwise rotation in degrees needed to display the video upright
+	Rotation int
+}
+
+// A single audio stream of a media file
+type AudioStream struct {
+
+	// Name of the codec, eg. "aac"
+	Codec string
+
+	// Bitrate in bit/s, 0 if unknown
+	Bitrate int
+
+	SampleRate int
+	Channels   int
+}
+
+// Returns the first video stream or nil if there is none
+func (info *MediaInfo) Video() *VideoStream {
+	if len(info.VideoStreams) == 0 {
+		return nil
+	}
+	return &info.VideoStreams[0]
+}
+
+// Rotation of the first video stream, 0 if there is no video
+func (info *MediaInfo) Rotation() int {
+	video := info.Video()
+	if video == nil {
+		return 0
+	}
+	return video.Rotation
+}
+
+// Returns the displayed dimensions of the stream taking rotation into account
+func (stream *VideoStream) DisplaySize() (int, int) {
+	if stream.Rotation == 90 || stream.Rotation == 270 {
+		return stream.Height, stream.Width
+	}
+	return stream.Width, stream.Height
+}
+
+// Value in the probe output, avprobe and ffprobe disagree whether numbers are
+// JSON strings or numbers so accept both
+type probeValue string
+
+func (value *probeValue) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		*value = probeValue(str)
+		return nil
+	}
+
+	var num json.Number
+	if err := json.Unmarshal(data, &num); err != nil {
+		return err
+	}
+	*value = probeValue(num.String())
+	return nil
+}
+
+func (value probeValue) Float() float64 {
+	result, err := strconv.ParseFloat(string(value), 64)
+	if err != nil || math.IsNaN(result) || math.IsInf(result, 0) {
+		return 0.0
+	}
+	return result
+}
+
+func (value probeValue) Int() int {
+	return int(value.Float())
+}
+
+// Parses a rational like "30000/1001"
+func (value probeValue) Rational() float64 {
+	parts := strings.SplitN(string(value), "/", 2)
+	if len(parts) != 2 {
+		return value.Float()
+	}
+
+	num := probeValue(parts[0]).Float()
+	den := probeValue(parts[1]).Float()
+	if den == 0.0 {
+		return 0.0
+	}
+	return num / den
+}
+
+// JSON output of `-show_format -show_streams`
+type probeOutput struct {
+	Format struct {
+		FormatName probeValue            `json:"format_name"`
+		Duration   probeValue            `json:"duration"`
+		BitRate    probeValue            `json:"bit_rate"`
+		Tags       map[string]probeValue `json:"tags"`
+	} `json:"format"`
+
+	Streams []struct {
+		CodecType    probeValue            `json:"codec_type"`
+		CodecName    probeValue            `json:"codec_name"`
+		Width        probeValue            `json:"width"`
+		Height       probeValue            `json:"height"`
+		AvgFrameRate probeValue            `json:"avg_frame_rate"`
+		RFrameRate   probeValue            `json:"r_frame_rate"`
+		BitRate      probeValue            `json:"bit_rate"`
+		SampleRate   probeValue            `json:"sample_rate"`
+		Channels     probeValue            `json:"channels"`
+		Tags         map[string]probeValue `json:"tags"`
+
+		// Newer ffprobe versions report rotation only as a display matrix
+		SideDataList []struct {
+			Rotation probeValue `json:"rotation"`
+		} `json:"side_data_list"`
+	} `json:"streams"`
+}
+
+// Formats of the `creation_time` tag used by different versions of the tools
+var creationTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+}
+
+func parseCreationTime(tags map[string]probeValue) time.Time {
+	value, ok := tags["creation_time"]
+	if !ok {
+		return time.Time{}
+	}
+
+	for _, layout := range creationTimeLayouts {
+		parsed, err := time.Parse(layout, string(value))
+		if err == nil {
+			return parsed
+		}
+	}
+	return time.Time{}
+}
+
+// Normalizes a rotation to one of 0, 90, 180 or 270
+func normalizeRotation(rotation int) int {
+	rotation = (rotation%360 + 360) % 360
+	return (rotation + 45) / 90 * 90 % 360
+}
+
+// Parses the JSON output of the probe
+func parseProbeOutput(output []byte) (*MediaInfo, error) {
+	var probe probeOutput
+	err := json.Unmarshal(output, &probe)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &MediaInfo{
+		Container:    string(probe.Format.FormatName),
+		Duration:     probe.Format.Duration.Float(),
+		Bitrate:      probe.Format.BitRate.Int(),
+		CreationTime: parseCreationTime(probe.Format.Tags),
+		VideoStreams: []VideoStream{},
+		AudioStreams: []AudioStream{},
+	}
+
+	for _, stream := range probe.Streams {
+		switch stream.CodecType {
+		case "video":
+			fps := stream.AvgFrameRate.Rational()
+			if fps == 0.0 {
+				fps = stream.RFrameRate.Rational()
+			}
+
+			// The display matrix rotation is counter-clockwise
+			rotation := 0
+			if rotate, ok := stream.Tags["rotate"]; ok {
+				rotation = rotate.Int()
+			} else {
+				for _, sideData := range stream.SideDataList {
+					if sideData.Rotation != "" {
+						rotation = -sideData.Rotation.Int()
+					}
+				}
+			}
+
+			info.VideoStreams = append(info.VideoStreams, VideoStream{
+				Codec:    string(stream.CodecName),
+				Width:    stream.Width.Int(),
+				Height:   stream.Height.Int(),
+				FPS:      fps,
+				Bitrate:  stream.BitRate.Int(),
+				Rotation: normalizeRotation(rotation),
+			})
+
+			if info.CreationTime.IsZero() {
+				info.CreationTime = parseCreationTime(stream.Tags)
+			}
+
+		case "audio":
+			info.AudioStreams = append(info.AudioStreams, AudioStream{
+				Codec:      string(stream.CodecName),
+				Bitrate:    stream.BitRate.Int(),
+				SampleRate: stream.SampleRate.Int(),
+				Channels:   stream.Channels.Int(),
+			})
+		}
+	}
+
+	return info, nil
+}
+
+// Reads the container and stream information of the media file at `path`
+func Probe(path string) (*MediaInfo, error) {
+
+	// Call the probe to print the format and streams as JSON
+	output, err := runProbe(current.ProbeArgs(path))
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := parseProbeOutput(output)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse probe output of %s: %s", path, err)
+	}
+
+	return info, nil
+}
@@ -0,0 +1,305 @@
+package transcode
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+// Captured outputs of the probes, trimmed to the fields that are read
+
+// ffprobe 4.2 of a portrait phone video, the rotation is both a tag and a
+// counter-clockwise display matrix
+const ffprobeRotateTag = `{
+    "streams": [
+        {
+            "index": 0,
+            "codec_name": "h264",
+            "codec_type": "video",
+            "width": 1920,
+            "height": 1080,
+            "r_frame_rate": "30/1",
+            "avg_frame_rate": "30000/1001",
+            "bit_rate": "10950112",
+            "tags": {
+                "rotate": "90",
+                "creation_time": "2019-03-01T12:34:56.000000Z",
+                "language": "und",
+                "handler_name": "Core Media Video"
+            },
+            "side_data_list": [
+                {
+                    "side_data_type": "Display Matrix",
+                    "displaymatrix": "\n00000000:            0       65536           0\n00000001:       -65536           0           0\n00000002:            0           0  1073741824\n",
+                    "rotation": -90
+                }
+            ]
+        },
+        {
+            "index": 1,
+            "codec_name": "aac",
+            "codec_type": "audio",
+            "sample_rate": "44100",
+            "channels": 1,
+            "bit_rate": "96000",
+            "tags": {
+                "creation_time": "2019-03-01T12:34:56.000000Z",
+                "language": "und"
+            }
+        }
+    ],
+    "format": {
+        "filename": "IMG_0001.MOV",
+        "format_name": "mov,mp4,m4a,3gp,3g2,mj2",
+        "duration": "5.568000",
+        "bit_rate": "11063510",
+        "tags": {
+            "major_brand": "qt  ",
+            "creation_time": "2019-03-01T12:34:56.000000Z"
+        }
+    }
+}`
+
+// ffprobe 6.0 reports the rotation only as the display matrix
+const ffprobeDisplayMatrix = `{
+    "streams": [
+        {
+            "index": 0,
+            "codec_name": "hevc",
+            "codec_type": "video",
+            "width": 3840,
+            "height": 2160,
+            "r_frame_rate": "60/1",
+            "avg_frame_rate": "0/0",
+            "tags": {
+                "language": "und"
+            },
+            "side_data_list": [
+                {
+                    "side_data_type": "Display Matrix",
+                    "displaymatrix": "\n00000000:            0      -65536           0\n00000001:        65536           0           0\n00000002:            0           0  1073741824\n",
+                    "rotation": 90
+                }
+            ]
+        }
+    ],
+    "format": {
+        "filename": "upside.mp4",
+        "format_name": "mov,mp4,m4a,3gp,3g2,mj2",
+        "duration": "2.000000",
+        "bit_rate": "N/A"
+    }
+}`
+
+// avprobe 11 prints numbers as strings and the old creation time format
+const avprobeRotateTag = `{
+    "streams": [
+        {
+            "index": "0",
+            "codec_name": "h264",
+            "codec_type": "video",
+            "width": "1280",
+            "height": "720",
+            "r_frame_rate": "25/1",
+            "avg_frame_rate": "25/1",
+            "bit_rate": "2368000",
+            "tags": {
+                "rotate": "180",
+                "creation_time": "2015-06-01 08:00:00",
+                "language": "eng"
+            }
+        },
+        {
+            "index": "1",
+            "codec_name": "aac",
+            "codec_type": "audio",
+            "sample_rate": "48000",
+            "channels": "2",
+            "bit_rate": "128000"
+        }
+    ],
+    "format": {
+        "filename": "camera.mp4",
+        "format_name": "mov,mp4,m4a,3gp,3g2,mj2",
+        "duration": "10.010000",
+        "bit_rate": "2500000"
+    }
+}`
+
+// ffprobe 4.2 of an audio file
+const ffprobeAudioOnly = `{
+    "streams": [
+        {
+            "index": 0,
+            "codec_name": "mp3",
+            "codec_type": "audio",
+            "sample_rate": "44100",
+            "channels": 2,
+            "bit_rate": "320000"
+        }
+    ],
+    "format": {
+        "filename": "song.mp3",
+        "format_name": "mp3",
+        "duration": "180.035918",
+        "bit_rate": "320069"
+    }
+}`
+
+func TestParseProbeOutput(t *testing.T) {
+	tests := []struct {
+		name         string
+		output       string
+		container    string
+		duration     float64
+		bitrate      int
+		creationTime time.Time
+		video        *VideoStream
+		audio        []AudioStream
+	}{
+		{"ffprobe rotate tag", ffprobeRotateTag, "mov,mp4,m4a,3gp,3g2,mj2", 5.568, 11063510,
+			time.Date(2019, 3, 1, 12, 34, 56, 0, time.UTC),
+			&VideoStream{Codec: "h264", Width: 1920, Height: 1080, FPS: 30000.0 / 1001.0, Bitrate: 10950112, Rotation: 90},
+			[]AudioStream{{Codec: "aac", Bitrate: 96000, SampleRate: 44100, Channels: 1}}},
+		{"ffprobe display matrix", ffprobeDisplayMatrix, "mov,mp4,m4a,3gp,3g2,mj2", 2.0, 0,
+			time.Time{},
+			&VideoStream{Codec: "hevc", Width: 3840, Height: 2160, FPS: 60.0, Rotation: 270},
+			[]AudioStream{}},
+		{"avprobe rotate tag", avprobeRotateTag, "mov,mp4,m4a,3gp,3g2,mj2", 10.01, 2500000,
+			time.Date(2015, 6, 1, 8, 0, 0, 0, time.UTC),
+			&VideoStream{Codec: "h264", Width: 1280, Height: 720, FPS: 25.0, Bitrate: 2368000, Rotation: 180},
+			[]AudioStream{{Codec: "aac", Bitrate: 128000, SampleRate: 48000, Channels: 2}}},
+		{"missing video stream", ffprobeAudioOnly, "mp3", 180.035918, 320069,
+			time.Time{},
+			nil,
+			[]AudioStream{{Codec: "mp3", Bitrate: 320000, SampleRate: 44100, Channels: 2}}},
+	}
+
+	for i, test := range tests {
+		info, err := parseProbeOutput([]byte(test.output))
+		if err != nil {
+			t.Errorf("%d %s: unexpected error: %s", i, test.name, err)
+			continue
+		}
+
+		if info.Container != test.container {
+			t.Errorf("%d %s: container %s, expected %s", i, test.name, info.Container, test.container)
+		}
+		if math.Abs(info.Duration-test.duration) > 1e-9 {
+			t.Errorf("%d %s: duration %g, expected %g", i, test.name, info.Duration, test.duration)
+		}
+		if info.Bitrate != test.bitrate {
+			t.Errorf("%d %s: bitrate %d, expected %d", i, test.name, info.Bitrate, test.bitrate)
+		}
+		if !info.CreationTime.Equal(test.creationTime) {
+			t.Errorf("%d %s: creation time %s, expected %s", i, test.name, info.CreationTime, test.creationTime)
+		}
+
+		video := info.Video()
+		if test.video == nil {
+			if video != nil {
+				t.Errorf("%d %s: unexpected video stream %+v", i, test.name, *video)
+			}
+			if info.Rotation() != 0 {
+				t.Errorf("%d %s: rotation %d without video", i, test.name, info.Rotation())
+			}
+		} else if video == nil {
+			t.Errorf("%d %s: missing video stream", i, test.name)
+		} else {
+			if math.Abs(video.FPS-test.video.FPS) > 1e-9 {
+				t.Errorf("%d %s: %g FPS, expected %g", i, test.name, video.FPS, test.video.FPS)
+			}
+			video.FPS = test.video.FPS
+			if *video != *test.video {
+				t.Errorf("%d %s: video stream %+v, expected %+v", i, test.name, *video, *test.video)
+			}
+			if info.Rotation() != test.video.Rotation {
+				t.Errorf("%d %s: rotation %d, expected %d", i, test.name, info.Rotation(), test.video.Rotation)
+			}
+		}
+
+		if len(info.AudioStreams) != len(test.audio) {
+			t.Errorf("%d %s: %d audio streams, expected %d", i, test.name, len(info.AudioStreams), len(test.audio))
+			continue
+		}
+		for j, audio := range info.AudioStreams {
+			if audio != test.audio[j] {
+				t.Errorf("%d %s: audio stream %d %+v, expected %+v", i, test.name, j, audio, test.audio[j])
+			}
+		}
+	}
+}
+
+func TestParseProbeOutputMalformed(t *testing.T) {
+	for i, output := range []string{"", "not json", `{"streams": {}}`, `{"format": {"duration": true}}`} {
+		if _, err := parseProbeOutput([]byte(output)); err == nil {
+			t.Errorf("%d %q: expected an error", i, output)
+		}
+	}
+}
+
+func TestProbeValue(t *testing.T) {
+	tests := []struct {
+		json     string
+		float    float64
+		integer  int
+		rational float64
+	}{
+		{`"1.5"`, 1.5, 1, 1.5},
+		{`1.5`, 1.5, 1, 1.5},
+		{`"1920"`, 1920.0, 1920, 1920.0},
+		{`1920`, 1920.0, 1920, 1920.0},
+		{`-90`, -90.0, -90, -90.0},
+		{`"N/A"`, 0.0, 0, 0.0},
+		{`"nan"`, 0.0, 0, 0.0},
+		{`"30000/1001"`, 0.0, 0, 30000.0 / 1001.0},
+		{`"25/1"`, 0.0, 0, 25.0},
+		{`"0/0"`, 0.0, 0, 0.0},
+		{`""`, 0.0, 0, 0.0},
+	}
+
+	for i, test := range tests {
+		var value probeValue
+		err := json.Unmarshal([]byte(test.json), &value)
+		if err != nil {
+			t.Errorf("%d %s: unexpected error: %s", i, test.json, err)
+			continue
+		}
+
+		if value.Float() != test.float {
+			t.Errorf("%d %s: float %g, expected %g", i, test.json, value.Float(), test.float)
+		}
+		if value.Int() != test.integer {
+			t.Errorf("%d %s: int %d, expected %d", i, test.json, value.Int(), test.integer)
+		}
+		if math.Abs(value.Rational()-test.rational) > 1e-9 {
+			t.Errorf("%d %s: rational %g, expected %g", i, test.json, value.Rational(), test.rational)
+		}
+	}
+}
+
+func TestNormalizeRotation(t *testing.T) {
+	tests := []struct {
+		rotation int
+		expected int
+	}{
+		{0, 0},
+		{90, 90},
+		{-90, 270},
+		{180, 180},
+		{-180, 180},
+		{270, 270},
+		{360, 0},
+		{450, 90},
+		{89, 90},
+		{44, 0},
+		{-1, 0},
+	}
+
+	for i, test := range tests {
+		if rotation := normalizeRotation(test.rotation); rotation != test.expected {
+			t.Errorf("%d %d: normalized to %d, expected %d", i, test.rotation, rotation, test.expected)
+		}
+	}
+}
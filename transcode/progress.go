@@ -0,0 +1,107 @@
+package transcode
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Progress of a running transcode, parsed from the statistics the encoder
+// prints to stderr
+type Progress struct {
+
+	// Percentage of the output done, 0 if the duration is not known
+	Percent float64
+
+	// Frames encoded per second
+	FPS float64
+
+	// Position of the encoder in the output in seconds
+	Time float64
+}
+
+// Regexes that match the encoder's statistics lines, eg.
+// "frame=  100 fps= 25 q=28.0 size=     256kB time=00:00:04.00 bitrate= 524.3kbits/s"
+// avconv prints the time in seconds, ffmpeg as HH:MM:SS.xx
+var reProgressTime = regexp.MustCompile("time=\\s*([\\d:.]+)")
+var reProgressFPS = regexp.MustCompile("fps=\\s*([\\d.]+)")
+
+// Parses a time either in seconds or as HH:MM:SS.xx
+func parseProgressTime(str string) (float64, bool) {
+	seconds := 0.0
+	for _, part := range strings.Split(str, ":") {
+		value, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0.0, false
+		}
+		seconds = seconds*60.0 + value
+	}
+	return seconds, true
+}
+
+// Parses a statistics line, returns false if the line is something else
+func parseProgressLine(line string, duration float64) (Progress, bool) {
+	timeMatches := reProgressTime.FindStringSubmatch(line)
+	if len(timeMatches) < 2 {
+		return Progress{}, false
+	}
+
+	time, ok := parseProgressTime(timeMatches[1])
+	if !ok {
+		return Progress{}, false
+	}
+
+	progress := Progress{Time: time}
+
+	fpsMatches := reProgressFPS.FindStringSubmatch(line)
+	if len(fpsMatches) >= 2 {
+		progress.FPS, _ = strconv.ParseFloat(fpsMatches[1], 64)
+	}
+
+	if duration > 0.0 {
+		progress.Percent = time / duration * 100.0
+		if progress.Percent > 100.0 {
+			progress.Percent = 100.0
+		}
+	}
+
+	return progress, true
+}
+
+// The statistics line is rewritten in place with carriage returns so split
+// the lines at both '\r' and '\n'
+func scanStatsLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// Reads the encoder's stderr from `r` and calls `onProgress` for every
+// statistics line, `duration` is the expected length of the output
+func readProgress(r io.Reader, duration float64, onProgress func(Progress)) {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(scanStatsLines)
+
+	for scanner.Scan() {
+		progress, ok := parseProgressLine(scanner.Text(), duration)
+		if ok {
+			onProgress(progress)
+		}
+	}
+
+	// Drain the rest so the encoder never blocks on a full pipe
+	_, _ = io.Copy(ioutil.Discard, r)
+}
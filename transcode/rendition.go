@@ -0,0 +1,143 @@
+package transcode
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A single quality level of adaptive streaming output
+type Rendition struct {
+
+	// Height of the video in pixels, the width follows the aspect ratio
+	Height int
+
+	// Target bitrates in kbit/s
+	VideoBitrate int
+	AudioBitrate int
+}
+
+// Name of the rendition used in file names, eg. "720p"
+func (rendition Rendition) Name() string {
+	return fmt.Sprintf("%dp", rendition.Height)
+}
+
+// Reasonable default rendition ladder for mobile recordings
+var DefaultRenditions = []Rendition{
+	{Height: 240, VideoBitrate: 400, AudioBitrate: 64},
+	{Height: 480, VideoBitrate: 1000, AudioBitrate: 96},
+	{Height: 720, VideoBitrate: 2500, AudioBitrate: 128},
+}
+
+// Parses a rendition ladder from a comma separated list of
+// `height:videoBitrate[:audioBitrate]` with bitrates in kbit/s
+// eg. "240:400:64,480:1000,720:2500"
+func ParseRenditions(ladder string) ([]Rendition, error) {
+	renditions := []Rendition{}
+
+	for _, entry := range strings.Split(ladder, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("Malformed rendition %s, expected height:videoBitrate[:audioBitrate]", entry)
+		}
+
+		values := []int{0, 0, 96}
+		for i, part := range parts {
+			value, err := strconv.Atoi(part)
+			if err != nil || value <= 0 {
+				return nil, fmt.Errorf("Malformed rendition %s, expected positive numbers", entry)
+			}
+			values[i] = value
+		}
+
+		renditions = append(renditions, Rendition{
+			Height:       values[0],
+			VideoBitrate: values[1],
+			AudioBitrate: values[2],
+		})
+	}
+
+	if len(renditions) == 0 {
+		return nil, fmt.Errorf("No renditions in %s", ladder)
+	}
+
+	return renditions, nil
+}
+
+// Returns the renditions that are not larger than the video, upscaling only
+// wastes bandwidth. If the video is smaller than every rendition the lowest
+// one is kept at the size of the video.
+func selectRenditions(renditions []Rendition, videoHeight int) []Rendition {
+	selected := []Rendition{}
+	lowest := -1
+
+	for i, rendition := range renditions {
+		if rendition.Height <= videoHeight {
+			selected = append(selected, rendition)
+		}
+		if lowest < 0 || rendition.Height < renditions[lowest].Height {
+			lowest = i
+		}
+	}
+
+	if len(selected) == 0 && lowest >= 0 {
+		rendition := renditions[lowest]
+		rendition.Height = videoHeight - videoHeight%2
+		selected = append(selected, rendition)
+	}
+
+	return selected
+}
+
+// Returns the displayed dimensions of the video taking rotation into account
+func displayResolution(videoPath string, options *Options) (int, int, error) {
+	info, err := Inspect(videoPath)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	video := info.Video()
+	if video == nil {
+		return 0, 0, fmt.Errorf("Did not find a video stream in %s", videoPath)
+	}
+	width, height := video.Width, video.Height
+
+	if options != nil {
+		width, height = rotatedSize(width, height, options.CompensateRotation)
+	}
+
+	return width, height, nil
+}
+
+// Size of a `width`x`height` frame rotated by `rotation` degrees, arbitrary
+// angles are enlarged to fit the whole frame like `RotationFilter` does
+func rotatedSize(width int, height int, rotation int) (int, int) {
+	if current.Name() == "libav" {
+		rotation = normalizeRotation(rotation)
+	}
+
+	switch wrapRotation(rotation) {
+	case 0, 180:
+		return width, height
+	case 90, 270:
+		return height, width
+	}
+
+	angle := float64(rotation) * math.Pi / 180.0
+	sin, cos := math.Abs(math.Sin(angle)), math.Abs(math.Cos(angle))
+	rotatedWidth := int(float64(width)*cos + float64(height)*sin)
+	rotatedHeight := int(float64(width)*sin + float64(height)*cos)
+	return rotatedWidth - rotatedWidth%2, rotatedHeight - rotatedHeight%2
+}
+
+// Width of a rendition with the same aspect ratio as `width`x`height`
+func renditionWidth(rendition Rendition, width int, height int) int {
+	scaled := rendition.Height * width / height
+	return scaled - scaled%2
+}
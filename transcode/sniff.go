@@ -0,0 +1,68 @@
+package transcode
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// Number of bytes needed from the beginning of a file to detect the container
+const sniffLength = 512
+
+// Box types that can start a QuickTime file that has no `ftyp` box
+var quickTimeBoxes = []string{"moov", "mdat", "free", "skip", "wide", "pnot"}
+
+// Detects the container format of `header`, the first bytes of a file.
+// Returns an empty string if it doesn't look like a video container.
+func sniffContainer(header []byte) string {
+
+	// ISO base media file format: MP4, MOV, 3GP
+	if len(header) >= 8 {
+		boxType := string(header[4:8])
+		if boxType == "ftyp" {
+			return "mp4"
+		}
+		for _, quickTimeBox := range quickTimeBoxes {
+			if boxType == quickTimeBox {
+				return "mov"
+			}
+		}
+	}
+
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return "matroska"
+	case len(header) >= 12 && bytes.HasPrefix(header, []byte("RIFF")) && string(header[8:12]) == "AVI ":
+		return "avi"
+	case bytes.HasPrefix(header, []byte("FLV")):
+		return "flv"
+	case bytes.HasPrefix(header, []byte("OggS")):
+		return "ogg"
+	case bytes.HasPrefix(header, []byte{0x30, 0x26, 0xB2, 0x75, 0x8E, 0x66, 0xCF, 0x11}):
+		return "asf"
+	case bytes.HasPrefix(header, []byte{0x00, 0x00, 0x01, 0xBA}):
+		return "mpeg"
+	case len(header) > 188 && header[0] == 0x47 && header[188] == 0x47:
+		return "mpegts"
+	}
+
+	return ""
+}
+
+// Detects the container format of the file at `path` from its magic bytes.
+// Returns an empty string if it doesn't look like a video container.
+func SniffContainer(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	header := make([]byte, sniffLength)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+
+	return sniffContainer(header[:n]), nil
+}
@@ -0,0 +1,225 @@
+package transcode
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Settings of a seek preview sprite sheet, see `GenerateSprites`
+type SpriteOptions struct {
+
+	// Seconds between the frames
+	Interval float64
+
+	// Width of a single frame in pixels, the height keeps the aspect ratio
+	Width int
+
+	// Number of frames per row of the sheet
+	Columns int
+
+	// URL of the sheet in the WebVTT cues, absolute or relative to the WebVTT file
+	ImageUrl string
+}
+
+// Long videos get a longer interval so the sheet stays a reasonable size
+const maxSpriteTiles = 1000
+
+// Quality of the assembled sheet
+const spriteJpegQuality = 80
+
+// Formats `seconds` as a WebVTT timestamp `hh:mm:ss.ttt`
+func formatVttTime(seconds float64) string {
+	ms := int(math.Round(seconds * 1000.0))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// Extract a frame every `interval` seconds of the video `src` into `dir`,
+// returns the paths of the frames in order
+func extractSpriteFrames(ctx context.Context, src string, dir string, interval float64, width int, options *Options, trimOptions *TrimOptions) ([]string, error) {
+	// Input file
+	args := inputArgs(src, trimOptions)
+
+	args = append(args,
+		// Overwrite
+		"-y",
+
+		// No audio
+		"-an",
+	)
+
+	// Trim the video
+	args = appendTrimOptions(args, trimOptions)
+
+	// Compensate the rotation before sampling and scaling the frames
+	filters := []string{}
+	if options != nil {
+		rotationOptions := *options
+		rotationOptions.Height = 0
+		if filter := videoFilter(&rotationOptions); filter != "" {
+			filters = append(filters, filter)
+		}
+	}
+	filters = append(filters,
+		fmt.Sprintf("fps=%g", 1.0/interval),
+		fmt.Sprintf("scale=%d:-1", width))
+	args = append(args, "-vf", strings.Join(filters, ","))
+
+	// Output files
+	args = append(args, "-q:v", "3", path.Join(dir, "%05d.jpg"))
+
+	err := runEncoder(ctx, args, 0.0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	frames := []string{}
+	for _, file := range files {
+		frames = append(frames, path.Join(dir, file.Name()))
+	}
+	sort.Strings(frames)
+
+	if len(frames) == 0 {
+		return nil, errors.New("No frames extracted for the sprite sheet")
+	}
+
+	return frames, nil
+}
+
+// Decode the image file at `imagePath`
+func readImageFile(imagePath string) (image.Image, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	return img, err
+}
+
+// Write `img` as a JPEG file to `dst`
+func writeJpegFile(img image.Image, dst string, quality int) error {
+	file, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	err = jpeg.Encode(file, img, &jpeg.Options{Quality: quality})
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Synchronously generate a seek preview from the video `src`: a sprite sheet
+// `dstImage` of frames every `spriteOptions.Interval` seconds laid out in rows,
+// and a WebVTT file `dstVtt` mapping the time ranges to the frames on the
+// sheet with `#xywh=` media fragments. `duration` is the length of the trimmed
+// video in seconds, or zero if not known. The rotation is compensated with
+// `options.CompensateRotation` and `options.Flip`, other options are ignored.
+func GenerateSprites(src string, dstImage string, dstVtt string, duration float64, spriteOptions *SpriteOptions, options *Options, trimOptions *TrimOptions) error {
+	return GenerateSpritesContext(context.Background(), src, dstImage, dstVtt, duration, spriteOptions, options, trimOptions)
+}
+
+// Like `GenerateSprites` but kills the encoder if `ctx` is cancelled or expires
+func GenerateSpritesContext(ctx context.Context, src string, dstImage string, dstVtt string, duration float64, spriteOptions *SpriteOptions, options *Options, trimOptions *TrimOptions) error {
+	if spriteOptions.Interval <= 0.0 || spriteOptions.Width <= 0 || spriteOptions.Columns <= 0 {
+		return errors.New("Sprite interval, width and columns must be positive")
+	}
+
+	interval := spriteOptions.Interval
+	if duration > 0.0 && duration/interval > maxSpriteTiles {
+		interval = duration / maxSpriteTiles
+	}
+
+	// The frames are extracted by the encoder and assembled here
+	dir := dstImage + ".frames"
+	_ = os.RemoveAll(dir)
+	err := os.Mkdir(dir, 0700)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	frames, err := extractSpriteFrames(ctx, src, dir, interval, spriteOptions.Width, options, trimOptions)
+	if err != nil {
+		return err
+	}
+	if len(frames) > maxSpriteTiles {
+		frames = frames[:maxSpriteTiles]
+	}
+
+	// Every frame has the size of the first one
+	first, err := readImageFile(frames[0])
+	if err != nil {
+		return err
+	}
+	tileWidth := first.Bounds().Dx()
+	tileHeight := first.Bounds().Dy()
+
+	columns := spriteOptions.Columns
+	if len(frames) < columns {
+		columns = len(frames)
+	}
+	rows := (len(frames) + columns - 1) / columns
+
+	sheet := image.NewRGBA(image.Rect(0, 0, columns*tileWidth, rows*tileHeight))
+
+	vtt, err := os.Create(dstVtt)
+	if err != nil {
+		return err
+	}
+	defer vtt.Close()
+
+	writer := bufio.NewWriter(vtt)
+	fmt.Fprint(writer, "WEBVTT\n")
+
+	for i, frame := range frames {
+		img := first
+		if i > 0 {
+			img, err = readImageFile(frame)
+			if err != nil {
+				return err
+			}
+		}
+
+		x := (i % columns) * tileWidth
+		y := (i / columns) * tileHeight
+		tile := image.Rect(x, y, x+tileWidth, y+tileHeight)
+		draw.Draw(sheet, tile, img, img.Bounds().Min, draw.Src)
+
+		start := float64(i) * interval
+		end := start + interval
+		if duration > start && (duration < end || i == len(frames)-1) {
+			end = duration
+		}
+
+		fmt.Fprintf(writer, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			formatVttTime(start), formatVttTime(end), spriteOptions.ImageUrl,
+			x, y, tileWidth, tileHeight)
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	return writeJpegFile(sheet, dstImage, spriteJpegQuality)
+}
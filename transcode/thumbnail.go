@@ -0,0 +1,323 @@
+package transcode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Quality of a frame as a thumbnail, the measures are normalized to [0, 1]
+type FrameScore struct {
+
+	// How close the average luminance is to the middle, black and white
+	// frames of fades score 0
+	Brightness float64
+
+	// Standard deviation of the luminance, flat frames like a hand over the
+	// lens score low
+	Contrast float64
+
+	// Variance of the Laplacian of the luminance, blurry frames score low
+	Sharpness float64
+
+	// Weighted combination of the above, higher is better
+	Total float64
+}
+
+// Frames are scored from a grid of at most this many pixels per side
+const scoreGridSize = 256
+
+// Luminances below or above these are considered black or white frames
+const darkLuminance = 20.0
+const brightLuminance = 235.0
+
+// Returns the luminance of the pixel in [0, 255]
+func luminance(img image.Image, x int, y int) float64 {
+	r, g, b, _ := img.At(x, y).RGBA()
+	return (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257.0
+}
+
+// Score `img` as a thumbnail, see `FrameScore`
+func ScoreFrame(img image.Image) FrameScore {
+	bounds := img.Bounds()
+
+	// Sample a grid so large frames don't take long to score
+	step := bounds.Dx() / scoreGridSize
+	if bounds.Dy()/scoreGridSize > step {
+		step = bounds.Dy() / scoreGridSize
+	}
+	if step < 1 {
+		step = 1
+	}
+
+	width := bounds.Dx() / step
+	height := bounds.Dy() / step
+	if width < 3 || height < 3 {
+		return FrameScore{}
+	}
+
+	luma := make([]float64, width*height)
+	sum := 0.0
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			value := luminance(img, bounds.Min.X+x*step, bounds.Min.Y+y*step)
+			luma[y*width+x] = value
+			sum += value
+		}
+	}
+	mean := sum / float64(len(luma))
+
+	variance := 0.0
+	for _, value := range luma {
+		variance += (value - mean) * (value - mean)
+	}
+	variance /= float64(len(luma))
+
+	// Laplacian of the interior pixels
+	laplacians := make([]float64, 0, (width-2)*(height-2))
+	laplacianSum := 0.0
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			i := y*width + x
+			laplacian := luma[i-width] + luma[i+width] + luma[i-1] + luma[i+1] - 4.0*luma[i]
+			laplacians = append(laplacians, laplacian)
+			laplacianSum += laplacian
+		}
+	}
+	laplacianMean := laplacianSum / float64(len(laplacians))
+	laplacianVariance := 0.0
+	for _, laplacian := range laplacians {
+		laplacianVariance += (laplacian - laplacianMean) * (laplacian - laplacianMean)
+	}
+	laplacianVariance /= float64(len(laplacians))
+
+	score := FrameScore{
+		Brightness: math.Max(0.0, 1.0-math.Abs(mean-128.0)/128.0),
+		Contrast:   math.Min(1.0, math.Sqrt(variance)/64.0),
+		Sharpness:  math.Min(1.0, math.Sqrt(laplacianVariance)/32.0),
+	}
+	score.Total = 0.3*score.Brightness + 0.3*score.Contrast + 0.4*score.Sharpness
+
+	// Never prefer black or white frames over anything else
+	if mean < darkLuminance || mean > brightLuminance {
+		score.Total *= 0.1
+	}
+
+	return score
+}
+
+// Score the image file at `imagePath`, see `ScoreFrame`
+func scoreImageFile(imagePath string) (FrameScore, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return FrameScore{}, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return FrameScore{}, err
+	}
+
+	return ScoreFrame(img), nil
+}
+
+// Synchronously generate a thumbnail from a video `src` to `dst` from the best
+// frame of the candidates at `times` seconds, see `ScoreFrame`.
+// Returns the time of the chosen frame.
+func GenerateBestThumbnail(src string, dst string, times []float64, options *Options) (float64, error) {
+	return GenerateBestThumbnailContext(context.Background(), src, dst, times, options)
+}
+
+// Like `GenerateBestThumbnail` but kills the encoder if `ctx` is cancelled or expires
+func GenerateBestThumbnailContext(ctx context.Context, src string, dst string, times []float64, options *Options) (float64, error) {
+	if len(times) == 0 {
+		return 0.0, errors.New("No thumbnail candidates")
+	}
+
+	bestPath := ""
+	bestTime := 0.0
+	bestScore := -1.0
+	var lastErr error
+
+	for i, time := range times {
+		candidatePath := fmt.Sprintf("%s.%d.jpg", dst, i)
+
+		err := GenerateThumbnailContext(ctx, src, candidatePath, time, options)
+		if err == nil {
+			var score FrameScore
+			score, err = scoreImageFile(candidatePath)
+			if err == nil && score.Total > bestScore {
+				if bestPath != "" {
+					_ = os.Remove(bestPath)
+				}
+				bestPath, bestTime, bestScore = candidatePath, time, score.Total
+				continue
+			}
+		}
+
+		_ = os.Remove(candidatePath)
+
+		// A cancelled encoder fails every candidate
+		if ctx.Err() != nil {
+			if bestPath != "" {
+				_ = os.Remove(bestPath)
+			}
+			return 0.0, ctx.Err()
+		}
+		if err != nil {
+			lastErr = err
+		}
+	}
+
+	if bestPath == "" {
+		return 0.0, lastErr
+	}
+
+	err := os.Rename(bestPath, dst)
+	if err != nil {
+		_ = os.Remove(bestPath)
+		return 0.0, err
+	}
+
+	return bestTime, nil
+}
+
+// Image formats of the resized thumbnails
+type ImageFormat string
+
+const (
+	ImageJPEG ImageFormat = "jpeg"
+	ImageWebP ImageFormat = "webp"
+)
+
+// Every resized thumbnail is generated in all of these formats
+var ThumbnailFormats = []ImageFormat{ImageJPEG, ImageWebP}
+
+// File extension of the format without the dot
+func (format ImageFormat) Extension() string {
+	if format == ImageJPEG {
+		return "jpg"
+	}
+	return string(format)
+}
+
+// MIME type of the format
+func (format ImageFormat) ContentType() string {
+	return "image/" + string(format)
+}
+
+// Encoder arguments for a single image in the format
+func (format ImageFormat) encoderArgs() []string {
+	if format == ImageWebP {
+		return []string{"-c:v", "libwebp", "-quality", "80"}
+	}
+	return []string{"-q:v", "3"}
+}
+
+// Resized copy of a thumbnail to generate, see `ResizeThumbnail`
+type ThumbnailVariant struct {
+	Width  int
+	Format ImageFormat
+	Path   string
+}
+
+// Parses thumbnail widths from a comma separated list of widths in pixels
+// with an optional `w` suffix like in `srcset`, eg. "160w,320w,640w"
+func ParseThumbnailWidths(list string) ([]int, error) {
+	widths := []int{}
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		width, err := strconv.Atoi(strings.TrimSuffix(entry, "w"))
+		if err != nil || width <= 0 {
+			return nil, fmt.Errorf("Malformed thumbnail width %s, expected a positive number", entry)
+		}
+		widths = append(widths, width)
+	}
+
+	return widths, nil
+}
+
+// Returns the formats of `ThumbnailFormats` the encoder can produce by resizing
+// a small image in the directory `dir`, the encoder may be built without some
+// of the libraries, eg. libwebp
+func SupportedThumbnailFormats(dir string) ([]ImageFormat, error) {
+	src := path.Join(dir, "thumbnail-formats.jpg")
+	err := writeJpegFile(image.NewRGBA(image.Rect(0, 0, 16, 16)), src, 90)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(src)
+
+	formats := []ImageFormat{}
+	for _, format := range ThumbnailFormats {
+		dst := path.Join(dir, "thumbnail-formats.8w."+format.Extension())
+		err = ResizeThumbnail(src, []ThumbnailVariant{{Width: 8, Format: format, Path: dst}})
+		_ = os.Remove(dst)
+		if err == nil {
+			formats = append(formats, format)
+		}
+	}
+
+	return formats, nil
+}
+
+// Synchronously resize the thumbnail image `src` to every variant keeping the
+// aspect ratio. Variants wider than `src` are not upscaled but get the size of
+// `src`. All the variants are encoded in a single run of the encoder.
+func ResizeThumbnail(src string, variants []ThumbnailVariant) error {
+	return ResizeThumbnailContext(context.Background(), src, variants)
+}
+
+// Like `ResizeThumbnail` but kills the encoder if `ctx` is cancelled or expires
+func ResizeThumbnailContext(ctx context.Context, src string, variants []ThumbnailVariant) error {
+	if len(variants) == 0 {
+		return nil
+	}
+
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	config, _, err := image.DecodeConfig(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	// Input file
+	args := inputArgs(src, nil)
+
+	args = append(args,
+		// Overwrite
+		"-y",
+	)
+
+	// Every variant is a separate output with its own options
+	for _, variant := range variants {
+		width := variant.Width
+		if width > config.Width {
+			width = config.Width
+		}
+
+		args = append(args, "-vf", fmt.Sprintf("scale=%d:-1", width))
+		args = append(args, variant.Format.encoderArgs()...)
+		args = append(args, variant.Path)
+	}
+
+	// Call the encoder to do the resizing
+	return runEncoder(ctx, args, 0.0, nil)
+}
@@ -1,65 +1,11 @@
 package transcode
 
 import (
-	"errors"
+	"context"
 	"fmt"
-	"os/exec"
-	"regexp"
-	"strconv"
+	"strings"
 )
 
-// Regex that matches `exiftool` output format
-var reRotation = regexp.MustCompile("Rotation\\s*:\\s*(\\d+)")
-
-// Regex that avprobe's duration output
-var reDuration = regexp.MustCompile("\\d+(\\.\\d+)?")
-
-// Extracts the rotation from the metadata of the video at `videoPath`
-func ExtractRotation(videoPath string) (int, error) {
-
-	// Call `exiftool` to read the metadata of the video
-	rotationCmd := exec.Command("exiftool", "-Rotation", videoPath)
-	rotationOutput, err := rotationCmd.Output()
-	if err != nil {
-		return 0, err
-	}
-
-	// Parse the output for "Rotation: \d+"
-	matches := reRotation.FindSubmatch(rotationOutput)
-	if len(matches) < 2 {
-		return 0, errors.New("Did not find rotation from exiftool output")
-	}
-
-	rotation, err := strconv.Atoi(string(matches[1]))
-	if err != nil {
-		return 0, err
-	}
-
-	return rotation, nil
-}
-
-// Extracts duration of the video at `videoPath`
-func ExtractDuration(videoPath string) (float64, error) {
-
-	// Call `avprobe` to read the metadata of the video
-	durationCmd := exec.Command("avprobe", "-v", "quiet", "-show_format_entry", "duration", videoPath)
-	durationOutput, err := durationCmd.Output()
-	if err != nil {
-		return 0.0, err
-	}
-
-	// Parse the duration from the outupt
-	var duration float64
-	num, err := fmt.Sscanf(reDuration.FindStringSubmatch(string(durationOutput))[1], "%f", &duration)
-	if err != nil {
-		return 0.0, err
-	} else if num != 1 {
-		return 0.0, fmt.Errorf("Failed to parse duration of %s", videoPath)
-	}
-
-	return duration, nil
-}
-
 // Represents a quality setting for transcoding
 type Quality int
 
@@ -71,37 +17,84 @@ const (
 	QualityHigh
 )
 
-// Trimming options for transcoding the video
+// A part of the source video to keep, the times are in milliseconds. Either
+// may be nil to keep the start or the end of the video.
+type TrimRange struct {
+	Start *int `json:"start,omitempty"`
+	End   *int `json:"end,omitempty"`
+}
+
+// Trimming options for transcoding the video: the parts of the source to keep
+// in order. Several ranges are cut and concatenated into one continuous video,
+// see `Edit`.
 type TrimOptions struct {
-	Start *int
-	End   *int
+	Ranges []TrimRange
 }
 
+// Mirroring of the video
+type Flip int
+
+const (
+	FlipNone Flip = iota
+
+	// Mirror left to right
+	FlipHorizontal
+
+	// Mirror upside down
+	FlipVertical
+)
+
 // For use with `TranscodeMP4`
 type Options struct {
 
-	// Rotates the video when transcoding (see `ExtractRotation`)
+	// Rotates the video clockwise by this many degrees when transcoding (see
+	// `MediaInfo.Rotation`), any angle is accepted
 	CompensateRotation int
 
+	// Mirrors the video after rotating it
+	Flip Flip
+
 	// Quality/performance setting (see `TranscodeQuality`)
 	Quality Quality
 
+	// Scales the video to this height keeping the aspect ratio, 0 keeps the size
+	Height int
+
+	// Target video bitrate in kbit/s, overrides `Quality` if non-zero
+	Bitrate int
+
 	// Custom arguments for the transcoder
 	ExtraArgs []string
-}
 
-// Arguments to normalize a rotation of a video
-var rotationAvconvArguments = map[int][]string{
-	0:   {},
-	90:  {"-vf", "transpose=1"},
-	180: {"-vf", "vflip,hflip"},
-	270: {"-vf", "transpose=3"},
+	// Duration of the source video in seconds, used for `Progress.Percent`
+	Duration float64
+
+	// Called with the progress of `TranscodeMP4` whenever the encoder reports
+	// it, optional
+	OnProgress func(progress Progress)
 }
 
-// Arguments for specified quality settings
-var qualityAvconvArguments = map[Quality][]string{
-	QualityLow:  {"-preset", "ultrafast"},
-	QualityHigh: {"-qscale", "1"},
+// Returns the video filter chain for rotation compensation and scaling, there
+// can be only one filter argument per stream so they need to be combined
+func videoFilter(options *Options) string {
+	filters := []string{}
+
+	rotationFilter := current.RotationFilter(options.CompensateRotation)
+	if rotationFilter != "" {
+		filters = append(filters, rotationFilter)
+	}
+
+	flipFilter := flipAvconvFilters[options.Flip]
+	if flipFilter != "" {
+		filters = append(filters, flipFilter)
+	}
+
+	// Keep the width divisible by two as required by h264
+	if options.Height > 0 {
+		filters = append(filters, fmt.Sprintf("scale=trunc(oh*a/2)*2:%d", options.Height))
+	}
+
+	return strings.Join(filters, ",")
 }
 
 func appendOptions(args []string, options *Options) []string {
@@ -109,16 +102,23 @@ func appendOptions(args []string, options *Options) []string {
 		return args
 	}
 
-	// Rotation compensation
-	rotationArgs := rotationAvconvArguments[options.CompensateRotation]
-	if rotationArgs != nil && len(rotationArgs) > 0 {
-		args = append(args, rotationArgs...)
+	// Video filters
+	filter := videoFilter(options)
+	if filter != "" {
+		args = append(args, "-vf", filter)
 	}
 
 	// Quality settings
-	qualityArgs := qualityAvconvArguments[options.Quality]
-	if qualityArgs != nil && len(qualityArgs) > 0 {
-		args = append(args, qualityArgs...)
+	if options.Bitrate > 0 {
+		args = append(args,
+			"-b:v", fmt.Sprintf("%dk", options.Bitrate),
+			"-maxrate", fmt.Sprintf("%dk", options.Bitrate),
+			"-bufsize", fmt.Sprintf("%dk", options.Bitrate*2))
+	} else {
+		qualityArgs := current.QualityArgs(options.Quality)
+		if len(qualityArgs) > 0 {
+			args = append(args, qualityArgs...)
+		}
 	}
 
 	// Custom arguments
@@ -129,28 +129,54 @@ func appendOptions(args []string, options *Options) []string {
 	return args
 }
 
+// Appends the output side of the trimming, the start is part of `inputArgs`
 func appendTrimOptions(args []string, trimOptions *TrimOptions) []string {
-	if trimOptions == nil || trimOptions.End == nil || trimOptions.Start == nil {
-		return args
-	}
-
-	trimArgs := []string{
-		"-ss", strconv.Itoa(*trimOptions.Start / 1000),
-		"-t", strconv.Itoa((*trimOptions.End - *trimOptions.Start) / 1000),
-	}
+	_, outputArgs := current.TrimArgs(trimOptions)
+	return append(args, outputArgs...)
+}
 
-	args = append(args, trimArgs...)
+// Appends the arguments that clear the rotation metadata of the output video
+// streams. The encoders copy it from the input, but the rotation is already
+// compensated with `videoFilter` so players would rotate the video again.
+func appendClearRotation(args []string) []string {
+	return append(args, "-metadata:s:v", "rotate=0")
+}
 
-	return args
+// Appends the arguments that force a keyframe at the start of every
+// `segmentTime` second segment of a streaming output, the muxers can only cut
+// the segments at keyframes
+func appendSegmentKeyframes(args []string, segmentTime int, options *Options) []string {
+	duration := 0.0
+	if options != nil {
+		duration = options.Duration
+	}
+	return append(args, current.KeyframeArgs(segmentTime, duration)...)
 }
 
 // Synchronously transcode a video from `src` to `dst` using `options`
 // See `TranscodeOptions`
 func TranscodeMP4(src string, dst string, options *Options, trimOptions *TrimOptions) error {
-	args := []string{
-		// Input file
-		"-i", src,
+	return TranscodeMP4Context(context.Background(), src, dst, options, trimOptions)
+}
 
+// Like `TranscodeMP4` but kills the encoder if `ctx` is cancelled or expires
+func TranscodeMP4Context(ctx context.Context, src string, dst string, options *Options, trimOptions *TrimOptions) error {
+	duration := 0.0
+	if options != nil {
+		duration = trimOptions.Duration(options.Duration)
+	}
+
+	// Concatenate the ranges first if there are several
+	src, options, trimOptions, cleanup, err := editedSource(ctx, src, dst, options, trimOptions)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	// Input file
+	args := inputArgs(src, trimOptions)
+
+	args = append(args,
 		// Overwrite
 		"-y",
 
@@ -159,13 +185,11 @@ func TranscodeMP4(src string, dst string, options *Options, trimOptions *TrimOpt
 
 		// Convert video: h264
 		"-c:v", "h264",
-
-		// Log level
-		"-v", "warning",
-	}
+	)
 
 	// Options
 	args = appendOptions(args, options)
+	args = appendClearRotation(args)
 
 	// Trimming options
 	args = appendTrimOptions(args, trimOptions)
@@ -173,31 +197,35 @@ func TranscodeMP4(src string, dst string, options *Options, trimOptions *TrimOpt
 	// Output file
 	args = append(args, dst)
 
-	// Call `avconv` to do the transcoding
-	transcodeCmd := exec.Command("avconv", args...)
-	err := transcodeCmd.Run()
-
-	return err
+	// Call the encoder to do the transcoding
+	if options != nil && options.OnProgress != nil {
+		return runEncoder(ctx, args, duration, options.OnProgress)
+	}
+	return runEncoder(ctx, args, 0.0, nil)
 }
 
 // Synchronously generate a thumbnail from a video `src` to `dst`
 func GenerateThumbnail(src string, dst string, time float64, options *Options) error {
-	args := []string{
-		// Input file
-		"-i", src,
+	return GenerateThumbnailContext(context.Background(), src, dst, time, options)
+}
 
-		// Overwrite
-		"-y",
+// Like `GenerateThumbnail` but kills the encoder if `ctx` is cancelled or expires
+func GenerateThumbnailContext(ctx context.Context, src string, dst string, time float64, options *Options) error {
+	// Seek the input to the time
+	seekArgs, frameArgs := current.ThumbnailArgs(time)
+	args := append([]string{}, current.InputArgs()...)
+	args = append(args, seekArgs...)
 
-		// Time
-		"-ss", fmt.Sprintf("%.4f", time),
+	// Input file
+	args = append(args, "-i", src)
 
-		// Only one frame
-		"-frames:v", "1",
+	args = append(args,
+		// Overwrite
+		"-y",
+	)
 
-		// Log level
-		"-v", "warning",
-	}
+	// A single frame
+	args = append(args, frameArgs...)
 
 	// Options
 	args = appendOptions(args, options)
@@ -205,8 +233,6 @@ func GenerateThumbnail(src string, dst string, time float64, options *Options) e
 	// Output file
 	args = append(args, dst)
 
-	// Call `avconv` to do the transcoding
-	transcodeCmd := exec.Command("avconv", args...)
-	err := transcodeCmd.Run()
-	return err
+	// Call the encoder to do the transcoding
+	return runEncoder(ctx, args, 0.0, nil)
 }
@@ -0,0 +1,386 @@
+package transcode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// A suite of command line tools used for transcoding and probing videos.
+// libav and FFmpeg share most of their interface but differ in some arguments
+// and defaults, the differences are mapped here.
+type Transcoder interface {
+
+	// Name of the tool suite, eg. "ffmpeg"
+	Name() string
+
+	// Executables for transcoding and probing, eg. "ffmpeg" and "ffprobe"
+	EncoderCommand() string
+	ProbeCommand() string
+
+	// Arguments placed before the input file
+	InputArgs() []string
+
+	// Arguments for the log level, `stats` enables printing progress
+	// statistics to stderr
+	LogArgs(stats bool) []string
+
+	// Video filter that rotates the video clockwise by `rotation` degrees,
+	// any angle is accepted
+	RotationFilter(rotation int) string
+
+	// Arguments for the quality setting `quality`
+	QualityArgs(quality Quality) []string
+
+	// Arguments that trim the output, nil if not trimmed. `input` is placed
+	// before the input file so the seek is both fast and frame accurate,
+	// `output` after it.
+	TrimArgs(trimOptions *TrimOptions) (input []string, output []string)
+
+	// Arguments that output a single frame at `time` seconds. `input` is
+	// placed before the input file so the seek doesn't decode the video up
+	// to the time, `output` after it.
+	ThumbnailArgs(time float64) (input []string, output []string)
+
+	// Arguments for the DASH muxer with `segmentTime` second segments
+	DashArgs(segmentTime int) []string
+
+	// Arguments that force a keyframe every `segmentTime` seconds of the
+	// output, `duration` is the length of the output in seconds or 0 if not
+	// known
+	KeyframeArgs(segmentTime int, duration float64) []string
+
+	// Arguments for the probe to print the format and streams of the video at
+	// `videoPath` as JSON
+	ProbeArgs(videoPath string) []string
+}
+
+// Video filters to normalize a rotation of a video by right angles
+var rotationAvconvFilters = map[int]string{
+	0:   "",
+	90:  "transpose=clock",
+	180: "vflip,hflip",
+	270: "transpose=cclock",
+}
+
+// Video filters for flipping a video
+var flipAvconvFilters = map[Flip]string{
+	FlipNone:       "",
+	FlipHorizontal: "hflip",
+	FlipVertical:   "vflip",
+}
+
+// Returns `rotation` in the range [0, 360)
+func wrapRotation(rotation int) int {
+	return (rotation%360 + 360) % 360
+}
+
+// Arguments for specified quality settings
+var qualityAvconvArguments = map[Quality][]string{
+	QualityLow:  {"-preset", "ultrafast"},
+	QualityHigh: {"-qscale", "1"},
+}
+
+// FFmpeg's x264 wrapper ignores `-qscale`, use a constant rate factor instead
+var qualityFFmpegArguments = map[Quality][]string{
+	QualityLow:  {"-preset", "ultrafast"},
+	QualityHigh: {"-preset", "slow", "-crf", "18"},
+}
+
+// Formats a time in milliseconds as fractional seconds
+func formatMilliseconds(ms int) string {
+	return fmt.Sprintf("%d.%03d", ms/1000, ms%1000)
+}
+
+// Trim arguments are the same for both tools. Seeking the input resets the
+// timestamps so the length of the output is relative to the start.
+// Only a single range can be trimmed with arguments, see `Edit`.
+func trimArguments(trimOptions *TrimOptions) ([]string, []string) {
+	if trimOptions == nil || len(trimOptions.Ranges) != 1 {
+		return nil, nil
+	}
+	trimRange := trimOptions.Ranges[0]
+
+	var input, output []string
+	start := 0
+	if trimRange.Start != nil && *trimRange.Start > 0 {
+		start = *trimRange.Start
+		input = []string{"-ss", formatMilliseconds(start)}
+	}
+	if trimRange.End != nil && *trimRange.End > start {
+		output = []string{"-t", formatMilliseconds(*trimRange.End - start)}
+	}
+
+	return input, output
+}
+
+// Thumbnail arguments are the same for both tools
+func thumbnailArguments(time float64) ([]string, []string) {
+	// Time
+	input := []string{"-ss", fmt.Sprintf("%.4f", time)}
+
+	// Only one frame
+	output := []string{"-frames:v", "1"}
+
+	return input, output
+}
+
+// avconv and avprobe from libav
+type libavTranscoder struct{}
+
+func (libavTranscoder) Name() string           { return "libav" }
+func (libavTranscoder) EncoderCommand() string { return "avconv" }
+func (libavTranscoder) ProbeCommand() string   { return "avprobe" }
+
+func (libavTranscoder) InputArgs() []string {
+	return nil
+}
+
+// avconv prints the statistics only at the info level
+func (libavTranscoder) LogArgs(stats bool) []string {
+	if stats {
+		return []string{"-v", "info", "-stats"}
+	}
+	return []string{"-v", "warning"}
+}
+
+// libav has no filter for arbitrary rotation, round to the closest right angle
+func (libavTranscoder) RotationFilter(rotation int) string {
+	return rotationAvconvFilters[normalizeRotation(rotation)]
+}
+
+func (libavTranscoder) QualityArgs(quality Quality) []string {
+	return qualityAvconvArguments[quality]
+}
+
+func (libavTranscoder) TrimArgs(trimOptions *TrimOptions) ([]string, []string) {
+	return trimArguments(trimOptions)
+}
+
+func (libavTranscoder) ThumbnailArgs(time float64) ([]string, []string) {
+	return thumbnailArguments(time)
+}
+
+// libav's DASH muxer takes the segment duration in microseconds
+func (libavTranscoder) DashArgs(segmentTime int) []string {
+	return []string{"-min_seg_duration", strconv.Itoa(segmentTime * 1000000)}
+}
+
+// avconv accepts only a list of times, without the duration the keyframes are
+// left to the encoder
+func (libavTranscoder) KeyframeArgs(segmentTime int, duration float64) []string {
+	if duration <= 0.0 {
+		return nil
+	}
+
+	times := []string{}
+	for time := 0; float64(time) < duration; time += segmentTime {
+		times = append(times, strconv.Itoa(time))
+	}
+	return []string{"-force_key_frames", strings.Join(times, ",")}
+}
+
+func (libavTranscoder) ProbeArgs(videoPath string) []string {
+	return []string{"-v", "quiet", "-of", "json", "-show_format", "-show_streams", videoPath}
+}
+
+// ffmpeg and ffprobe from FFmpeg
+type ffmpegTranscoder struct{}
+
+func (ffmpegTranscoder) Name() string           { return "ffmpeg" }
+func (ffmpegTranscoder) EncoderCommand() string { return "ffmpeg" }
+func (ffmpegTranscoder) ProbeCommand() string   { return "ffprobe" }
+
+// FFmpeg rotates videos automatically based on the metadata, disable it since
+// the rotation is compensated explicitly with `RotationFilter`
+func (ffmpegTranscoder) InputArgs() []string {
+	return []string{"-noautorotate"}
+}
+
+// ffmpeg prints the statistics at any log level if explicitly requested
+func (ffmpegTranscoder) LogArgs(stats bool) []string {
+	if stats {
+		return []string{"-v", "warning", "-stats"}
+	}
+	return []string{"-v", "warning", "-nostats"}
+}
+
+// Right angles are transposed losslessly, other angles are rotated with the
+// output enlarged to fit the whole rotated frame, rounded to even for h264
+func (ffmpegTranscoder) RotationFilter(rotation int) string {
+	rotation = wrapRotation(rotation)
+	if filter, ok := rotationAvconvFilters[rotation]; ok {
+		return filter
+	}
+
+	angle := fmt.Sprintf("%d*PI/180", rotation)
+	return fmt.Sprintf("rotate=%[1]s:ow=trunc(rotw(%[1]s)/2)*2:oh=trunc(roth(%[1]s)/2)*2", angle)
+}
+
+func (ffmpegTranscoder) QualityArgs(quality Quality) []string {
+	return qualityFFmpegArguments[quality]
+}
+
+func (ffmpegTranscoder) TrimArgs(trimOptions *TrimOptions) ([]string, []string) {
+	return trimArguments(trimOptions)
+}
+
+func (ffmpegTranscoder) ThumbnailArgs(time float64) ([]string, []string) {
+	return thumbnailArguments(time)
+}
+
+// FFmpeg's DASH muxer takes the segment duration in seconds
+func (ffmpegTranscoder) DashArgs(segmentTime int) []string {
+	return []string{"-seg_duration", strconv.Itoa(segmentTime)}
+}
+
+// FFmpeg evaluates the expression for every frame, `n_forced` is the number of
+// keyframes forced so far
+func (ffmpegTranscoder) KeyframeArgs(segmentTime int, duration float64) []string {
+	return []string{"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", segmentTime)}
+}
+
+func (ffmpegTranscoder) ProbeArgs(videoPath string) []string {
+	return []string{"-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", videoPath}
+}
+
+// Supported transcoders in order of preference for `DetectTranscoder`
+var transcoders = []Transcoder{
+	ffmpegTranscoder{},
+	libavTranscoder{},
+}
+
+// The transcoder used by the package, libav unless changed with `SetTranscoder`
+var current Transcoder = libavTranscoder{}
+
+// Set the transcoder used by all the functions of the package
+// Note: Not thread safe, should be called before transcoding anything
+func SetTranscoder(transcoder Transcoder) {
+	current = transcoder
+}
+
+// Returns the transcoder used by the package
+func CurrentTranscoder() Transcoder {
+	return current
+}
+
+// Returns the transcoder called `name`, "ffmpeg" or "libav"
+func TranscoderByName(name string) (Transcoder, error) {
+	for _, transcoder := range transcoders {
+		if transcoder.Name() == name {
+			return transcoder, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown transcoder %s, use 'ffmpeg' or 'libav'", name)
+}
+
+// Returns true if the executables of `transcoder` are found in PATH
+func isInstalled(transcoder Transcoder) bool {
+	if _, err := exec.LookPath(transcoder.EncoderCommand()); err != nil {
+		return false
+	}
+	if _, err := exec.LookPath(transcoder.ProbeCommand()); err != nil {
+		return false
+	}
+	return true
+}
+
+// Finds an installed transcoder from PATH, FFmpeg is preferred over libav
+func DetectTranscoder() (Transcoder, error) {
+	for _, transcoder := range transcoders {
+		if isInstalled(transcoder) {
+			return transcoder, nil
+		}
+	}
+	return nil, errors.New("Did not find ffmpeg/ffprobe or avconv/avprobe in PATH")
+}
+
+// Returns the arguments to read the input file `src` starting from the trim
+// start of `trimOptions`, which may be nil
+func inputArgs(src string, trimOptions *TrimOptions) []string {
+	args := append([]string{}, current.InputArgs()...)
+	seekArgs, _ := current.TrimArgs(trimOptions)
+	args = append(args, seekArgs...)
+	return append(args, "-i", src)
+}
+
+// Kill the process and every process it has started
+func killProcessGroup(process *os.Process) {
+	err := syscall.Kill(-process.Pid, syscall.SIGKILL)
+	if err != nil {
+		_ = process.Kill()
+	}
+}
+
+// Synchronously run the encoder with `args`, the log level is set here.
+// If `onProgress` is not nil it's called with the progress of the encoder,
+// `duration` is the expected length of the output in seconds.
+// The encoder is killed if `ctx` is cancelled, then the error of `ctx` is returned.
+// If the encoder fails the error is a `*TranscodeError` classified from its output.
+func runEncoder(ctx context.Context, args []string, duration float64, onProgress func(Progress)) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	args = append(current.LogArgs(onProgress != nil), args...)
+	encodeCmd := exec.Command(current.EncoderCommand(), args...)
+
+	// Run in a separate process group so helpers started by the encoder are
+	// killed along with it
+	encodeCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	// Keep the end of the error output to explain failures
+	tail := &tailBuffer{limit: stderrTailSize}
+
+	var stderr io.ReadCloser
+	if onProgress != nil {
+		var err error
+		stderr, err = encodeCmd.StderrPipe()
+		if err != nil {
+			return err
+		}
+	} else {
+		encodeCmd.Stderr = tail
+	}
+
+	err := encodeCmd.Start()
+	if err != nil {
+		return err
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(encodeCmd.Process)
+		case <-exited:
+		}
+	}()
+
+	// The pipe must be read completely before waiting for the process
+	if stderr != nil {
+		readProgress(io.TeeReader(stderr, tail), duration, onProgress)
+	}
+	err = encodeCmd.Wait()
+	close(exited)
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return classifyFailure(err, tail.String())
+	}
+	return nil
+}
+
+// Run the probe with `args` and return its standard output
+func runProbe(args []string) ([]byte, error) {
+	probeCmd := exec.Command(current.ProbeCommand(), args...)
+	return probeCmd.Output()
+}
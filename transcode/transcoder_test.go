@@ -0,0 +1,265 @@
+package transcode
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// FFmpeg with the encoder replaced by a script that records the arguments of
+// every run to a log, one argument per line and runs separated by "--"
+type recordingTranscoder struct {
+	ffmpegTranscoder
+	script string
+}
+
+func (self recordingTranscoder) EncoderCommand() string { return self.script }
+
+// Use a `recordingTranscoder` in `dir` until the returned function is called
+func recordEncoderRuns(t *testing.T, dir string) (string, func()) {
+	logPath := path.Join(dir, "encoder.log")
+	script := path.Join(dir, "encoder.sh")
+	err := ioutil.WriteFile(script, []byte("#!/bin/sh\nprintf '%s\\n' \"$@\" -- >> '"+logPath+"'\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := CurrentTranscoder()
+	SetTranscoder(recordingTranscoder{script: script})
+	return logPath, func() { SetTranscoder(previous) }
+}
+
+// Returns the arguments of every recorded run of the encoder
+func recordedRuns(t *testing.T, logPath string) [][]string {
+	data, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runs := [][]string{}
+	run := []string{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if line == "--" {
+			runs = append(runs, run)
+			run = []string{}
+		} else {
+			run = append(run, line)
+		}
+	}
+	return runs
+}
+
+// Returns true if `args` contains `expected` as consecutive arguments
+func hasArgs(args []string, expected ...string) bool {
+	for i := 0; i+len(expected) <= len(args); i++ {
+		if strings.Join(args[i:i+len(expected)], "\x00") == strings.Join(expected, "\x00") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEncodesClearRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transcodertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := writeFixture(t, dir, "rotated.mp4", concat(ftyp(), fixtureMoov(0, 0, rotationMatrix(90))))
+	options := &Options{CompensateRotation: 90}
+	start := 1000
+	end := 2000
+	trimmed := &TrimOptions{Ranges: []TrimRange{{Start: &start}}}
+	edited := &TrimOptions{Ranges: []TrimRange{{End: &start}, {Start: &end}}}
+
+	tests := []struct {
+		name   string
+		encode func() error
+		runs   int
+	}{
+		{"mp4", func() error {
+			return TranscodeMP4(src, path.Join(dir, "out.mp4"), options, trimmed)
+		}, 1},
+		{"edited mp4", func() error {
+			return TranscodeMP4(src, path.Join(dir, "out.mp4"), options, edited)
+		}, 4},
+		{"hls", func() error {
+			return TranscodeHLS(src, path.Join(dir, "hls"), DefaultRenditions, options, trimmed)
+		}, 3},
+		{"dash", func() error {
+			return TranscodeDASH(src, path.Join(dir, "dash"), DefaultRenditions, options, trimmed)
+		}, 1},
+	}
+
+	for i, test := range tests {
+		logPath, restore := recordEncoderRuns(t, dir)
+		err := test.encode()
+		restore()
+		if err != nil {
+			t.Errorf("%d %s: unexpected error: %s", i, test.name, err)
+			continue
+		}
+
+		runs := recordedRuns(t, logPath)
+		if len(runs) != test.runs {
+			t.Errorf("%d %s: %d encoder runs, expected %d", i, test.name, len(runs), test.runs)
+		}
+		for j, args := range runs {
+			if !hasArgs(args, "-metadata:s:v", "rotate=0") {
+				t.Errorf("%d %s: run %d does not clear the rotation: %v", i, test.name, j, args)
+			}
+		}
+		_ = os.Remove(logPath)
+	}
+}
+
+func TestThumbnailSeeksInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transcodertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logPath, restore := recordEncoderRuns(t, dir)
+	defer restore()
+
+	src := path.Join(dir, "video.mp4")
+	times := []float64{1.5, 3000.25}
+	seekTimes := []string{"1.5000", "3000.2500"}
+	_, _ = GenerateBestThumbnail(src, path.Join(dir, "thumb.jpg"), times, nil)
+
+	runs := recordedRuns(t, logPath)
+	if len(runs) != len(times) {
+		t.Fatalf("%d encoder runs, expected %d", len(runs), len(times))
+	}
+	for i, args := range runs {
+		if !hasArgs(args, "-ss", seekTimes[i], "-i", src) {
+			t.Errorf("Candidate %d does not seek the input: %v", i, args)
+		}
+		if !hasArgs(args, "-frames:v", "1") {
+			t.Errorf("Candidate %d does not output a single frame: %v", i, args)
+		}
+	}
+}
+
+func TestFormatMilliseconds(t *testing.T) {
+	tests := []struct {
+		ms       int
+		expected string
+	}{
+		{0, "0.000"},
+		{5, "0.005"},
+		{50, "0.050"},
+		{999, "0.999"},
+		{1000, "1.000"},
+		{61050, "61.050"},
+	}
+
+	for i, test := range tests {
+		if formatted := formatMilliseconds(test.ms); formatted != test.expected {
+			t.Errorf("%d %d: formatted as %s, expected %s", i, test.ms, formatted, test.expected)
+		}
+	}
+}
+
+func TestTrimArguments(t *testing.T) {
+	tests := []struct {
+		name   string
+		trim   *TrimOptions
+		input  []string
+		output []string
+	}{
+		{"no trimming", nil, nil, nil},
+		{"no ranges", &TrimOptions{}, nil, nil},
+		{"several ranges", &TrimOptions{Ranges: []TrimRange{{End: ms(1000)}, {Start: ms(2000)}}}, nil, nil},
+		{"open end", &TrimOptions{Ranges: []TrimRange{{Start: ms(1500)}}}, []string{"-ss", "1.500"}, nil},
+		{"open start", &TrimOptions{Ranges: []TrimRange{{End: ms(2000)}}}, nil, []string{"-t", "2.000"}},
+		{"zero start", &TrimOptions{Ranges: []TrimRange{{Start: ms(0), End: ms(1000)}}}, nil, []string{"-t", "1.000"}},
+		{"closed", &TrimOptions{Ranges: []TrimRange{{Start: ms(1500), End: ms(4250)}}},
+			[]string{"-ss", "1.500"}, []string{"-t", "2.750"}},
+		{"milliseconds", &TrimOptions{Ranges: []TrimRange{{Start: ms(5), End: ms(1006)}}},
+			[]string{"-ss", "0.005"}, []string{"-t", "1.001"}},
+		{"start past the end", &TrimOptions{Ranges: []TrimRange{{Start: ms(5000), End: ms(3000)}}},
+			[]string{"-ss", "5.000"}, nil},
+	}
+
+	for i, test := range tests {
+		input, output := trimArguments(test.trim)
+		if !reflect.DeepEqual(input, test.input) {
+			t.Errorf("%d %s: input arguments %v, expected %v", i, test.name, input, test.input)
+		}
+		if !reflect.DeepEqual(output, test.output) {
+			t.Errorf("%d %s: output arguments %v, expected %v", i, test.name, output, test.output)
+		}
+	}
+}
+
+func TestStreamingKeyframes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transcodertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := writeFixture(t, dir, "video.mp4", concat(ftyp(), fixtureMoov(0, 0, rotationMatrix(0))))
+	options := &Options{Duration: 10.0}
+
+	tests := []struct {
+		name       string
+		encode     func() error
+		expression string
+	}{
+		{"hls", func() error {
+			return TranscodeHLS(src, path.Join(dir, "hls"), DefaultRenditions, options, nil)
+		}, "expr:gte(t,n_forced*6)"},
+		{"dash", func() error {
+			return TranscodeDASH(src, path.Join(dir, "dash"), DefaultRenditions, options, nil)
+		}, "expr:gte(t,n_forced*4)"},
+	}
+
+	for i, test := range tests {
+		logPath, restore := recordEncoderRuns(t, dir)
+		err := test.encode()
+		restore()
+		if err != nil {
+			t.Errorf("%d %s: unexpected error: %s", i, test.name, err)
+			continue
+		}
+
+		runs := recordedRuns(t, logPath)
+		if len(runs) == 0 {
+			t.Errorf("%d %s: the encoder was not run", i, test.name)
+		}
+		for j, args := range runs {
+			if !hasArgs(args, "-force_key_frames", test.expression) {
+				t.Errorf("%d %s: run %d does not force keyframes at the segments: %v", i, test.name, j, args)
+			}
+		}
+		_ = os.Remove(logPath)
+	}
+}
+
+func TestLibavKeyframeArgs(t *testing.T) {
+	tests := []struct {
+		segmentTime int
+		duration    float64
+		expected    []string
+	}{
+		{4, 0.0, nil},
+		{4, 3.5, []string{"-force_key_frames", "0"}},
+		{4, 8.0, []string{"-force_key_frames", "0,4"}},
+		{4, 8.5, []string{"-force_key_frames", "0,4,8"}},
+		{6, 20.0, []string{"-force_key_frames", "0,6,12,18"}},
+	}
+
+	for i, test := range tests {
+		args := libavTranscoder{}.KeyframeArgs(test.segmentTime, test.duration)
+		if !reflect.DeepEqual(args, test.expected) {
+			t.Errorf("%d %ds of %g: arguments %v, expected %v", i, test.segmentTime, test.duration, args, test.expected)
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"./jobstatus"
+
+	"github.com/gorilla/mux"
+)
+
+// Resumable uploads using the tus 1.0 protocol: http://tus.io/protocols/resumable-upload.html
+// Supports the core protocol and the `creation`, `termination` and
+// `expiration` extensions.
+//
+// The upload is written to the same `$token.dl.mp4` file as a regular upload
+// and the upload length and options are stored in the job manifest so uploads
+// can be resumed even after a restart. When the last byte is received the
+// video is queued for processing exactly like a regular upload. Uploads that
+// don't receive data for a while are removed, see `pruneExpiredTusUploads`.
+
+const tusVersion = "1.0.0"
+
+// How long an incomplete upload is kept after it last received data, zero
+// keeps them until they are completed or deleted
+var tusUploadExpiry = 24 * time.Hour
+
+// How often to look for expired uploads
+const tusPruneInterval = 1 * time.Hour
+
+// Uploads that are currently receiving data, a single upload can't be
+// appended to by multiple requests at the same time
+var tusActiveUploads = make(map[string]bool)
+var tusActiveMutex sync.Mutex
+
+// Mark the upload `token` as active, returns false if it already is
+func tusAcquire(token string) bool {
+	tusActiveMutex.Lock()
+	defer tusActiveMutex.Unlock()
+
+	if tusActiveUploads[token] {
+		return false
+	}
+	tusActiveUploads[token] = true
+	return true
+}
+
+func tusRelease(token string) {
+	tusActiveMutex.Lock()
+	defer tusActiveMutex.Unlock()
+
+	delete(tusActiveUploads, token)
+}
+
+// Parse the `Upload-Metadata` header: comma separated `key base64(value)` pairs
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, " ", 2)
+		if len(parts) == 1 {
+			metadata[parts[0]] = ""
+			continue
+		}
+
+		value, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, errors.New("Upload-Metadata is malformed")
+		}
+		metadata[parts[0]] = string(value)
+	}
+
+	return metadata, nil
+}
+
+// Load an incomplete upload of `user` from its manifest
+func loadTusUpload(token string, user string) (*videoToTranscode, jobstatus.State, int, error) {
+	manifest, err := readManifest(path.Join(tempBase, token+".job.json"))
+	if err != nil || manifest.UploadLength == 0 {
+		return nil, "", http.StatusNotFound, errors.New("Upload not found")
+	}
+
+	if manifest.Owner != user {
+		return nil, "", http.StatusForbidden, errors.New("Upload is owned by another user")
+	}
+
+	video := createVideoToTranscode(token, manifest.Edits, manifest.Owner)
+	video.title = manifest.Title
+	video.callbackUrl = manifest.Callback
+	video.rotate = manifest.Rotate
+	video.thumbnailTime = manifest.ThumbnailTime
+	video.uploadLength = manifest.UploadLength
+
+	return video, manifest.State, http.StatusOK, nil
+}
+
+// Returns the number of bytes received for the upload
+func tusUploadOffset(video *videoToTranscode, state jobstatus.State) (int64, error) {
+	// The downloaded file is renamed when the upload completes
+	if state != jobstatus.StateDownloading {
+		return video.uploadLength, nil
+	}
+
+	info, err := os.Stat(video.dlPath)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Set the `Upload-Expires` header for an upload that last received data at
+// `lastModified`, if uploads expire
+func setTusExpires(w http.ResponseWriter, lastModified time.Time) {
+	if tusUploadExpiry > 0 {
+		expires := lastModified.Add(tusUploadExpiry).UTC()
+		w.Header().Set("Upload-Expires", expires.Format(http.TimeFormat))
+	}
+}
+
+// Remove the incomplete upload `token` if it's still incomplete and release
+// its served files so the token is free again
+func pruneTusUpload(token string) {
+	manifest, err := readManifest(path.Join(tempBase, token+".job.json"))
+	if err != nil || manifest.UploadLength == 0 || manifest.State != jobstatus.StateDownloading {
+		return
+	}
+
+	log.Printf("%s: Resumable upload expired", token)
+
+	video := createVideoToTranscode(token, nil, manifest.Owner)
+	discardUpload(video)
+	jobs.Remove(token)
+}
+
+// Remove the incomplete uploads that have not received data within
+// `tusUploadExpiry`, every append touches the download file
+func pruneExpiredTusUploads() {
+	files, err := ioutil.ReadDir(tempBase)
+	if err != nil {
+		log.Printf("Failed to search expired uploads: %s", err.Error())
+		return
+	}
+
+	now := time.Now()
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".dl.mp4") {
+			continue
+		}
+		if now.Sub(file.ModTime()) <= tusUploadExpiry {
+			continue
+		}
+
+		// Skip the uploads that are receiving data right now
+		token := strings.TrimSuffix(file.Name(), ".dl.mp4")
+		if tusAcquire(token) {
+			pruneTusUpload(token)
+			tusRelease(token)
+		}
+	}
+}
+
+func pruneExpiredTusUploadsPeriodically() {
+	for {
+		pruneExpiredTusUploads()
+		time.Sleep(tusPruneInterval)
+	}
+}
+
+// Wraps a handler function and adds support for:
+// - Checking that the client speaks the same tus version
+// - tus and CORS headers for the responses
+func tusProtocolHandler(inner func(http.ResponseWriter, *http.Request) (int, error)) func(http.ResponseWriter, *http.Request) (int, error) {
+	return func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		w.Header().Set("Access-Control-Expose-Headers",
+			"Location, Upload-Offset, Upload-Length, Upload-Expires, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size")
+
+		if r.Method != "OPTIONS" && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			return http.StatusPreconditionFailed, errors.New("Unsupported tus version")
+		}
+
+		return inner(w, r)
+	}
+}
+
+// > OPTIONS /uploads/tus
+// > OPTIONS /uploads/tus/:token
+// Returns the supported tus version and extensions
+func tusOptionsHandler(methods ...string) func(http.ResponseWriter, *http.Request) (int, error) {
+	return func(w http.ResponseWriter, r *http.Request) (int, error) {
+		w.Header().Set("Tus-Version", tusVersion)
+		if tusUploadExpiry > 0 {
+			w.Header().Set("Tus-Extension", "creation,termination,expiration")
+		} else {
+			w.Header().Set("Tus-Extension", "creation,termination")
+		}
+		if maxUploadSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxUploadSize, 10))
+		}
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers",
+			"Authorization, Content-Type, Upload-Offset, Upload-Length, Upload-Metadata, Tus-Resumable")
+		w.WriteHeader(http.StatusNoContent)
+		return http.StatusNoContent, nil
+	}
+}
+
+// > POST /uploads/tus
+// Creates a new resumable upload, the upload length must be given in the
+// `Upload-Length` header. Supported `Upload-Metadata` keys:
+// - `filename`: Title of the video
+// - `start`, `end`: Trim times in milliseconds, see `uploadHandler`
+// - `edits`: JSON edit list instead of the trim times, see `parseEdits`
+// - `rotate`: Rotation override, see `parseRotate`
+// - `thumbnail`: Relative time of the thumbnail, see `parseThumbnailTime`
+// - `callback`: URL to notify of the processing phases, see `notifyVideo`
+// Returns the upload URL in `Location` and the video URLs as JSON.
+func tusCreateHandler(w http.ResponseWriter, r *http.Request, user string) (int, error) {
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		return http.StatusBadRequest, errors.New("Upload-Length is missing or malformed")
+	}
+
+	status, err := checkUploadAdmission(length)
+	if err != nil {
+		return status, err
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	edits, err := parseEdits(metadata["start"], metadata["end"], metadata["edits"])
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	rotate, err := parseRotate(metadata["rotate"])
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	thumbnailTime, err := parseThumbnailTime(metadata["thumbnail"])
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	callbackUrl, err := parseCallbackUrl(metadata["callback"])
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	video, err := reserveVideo(edits, user)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	video.title = metadata["filename"]
+	video.callbackUrl = callbackUrl
+	video.rotate = rotate
+	video.thumbnailTime = thumbnailTime
+	video.uploadLength = length
+
+	dlFile, err := os.Create(video.dlPath)
+	if err != nil {
+		releaseVideo(video)
+		return http.StatusInternalServerError, err
+	}
+	dlFile.Close()
+
+	setVideoState(video, jobstatus.StateDownloading)
+	log.Printf("%s: Created resumable upload of %d bytes", video.srcPath, length)
+
+	w.Header().Set("Location", apiUri+"/uploads/tus/"+video.token)
+	setTusExpires(w, time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	err = json.NewEncoder(w).Encode(createUploadResponse(video))
+	if err != nil {
+		log.Printf("Failed to send response: %s", err.Error())
+	}
+
+	return http.StatusCreated, nil
+}
+
+// > HEAD /uploads/tus/:token
+// Returns the number of received bytes in `Upload-Offset` and when the upload
+// expires in `Upload-Expires`
+func tusHeadHandler(w http.ResponseWriter, r *http.Request, user string) (int, error) {
+
+	vars := mux.Vars(r)
+	video, state, status, err := loadTusUpload(vars["token"], user)
+	if err != nil {
+		return status, err
+	}
+
+	offset, err := tusUploadOffset(video, state)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(video.uploadLength, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	if info, err := os.Stat(video.dlPath); err == nil {
+		setTusExpires(w, info.ModTime())
+	}
+	w.WriteHeader(http.StatusOK)
+	return http.StatusOK, nil
+}
+
+// > PATCH /uploads/tus/:token
+// Appends the body to the upload at `Upload-Offset`, which must match the
+// number of bytes received so far. Queues the video when it's complete.
+func tusPatchHandler(w http.ResponseWriter, r *http.Request, user string) (int, error) {
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		return http.StatusUnsupportedMediaType, errors.New("Content-Type must be application/offset+octet-stream")
+	}
+
+	vars := mux.Vars(r)
+	token := vars["token"]
+
+	if !tusAcquire(token) {
+		return http.StatusLocked, errors.New("Upload is already receiving data")
+	}
+	defer tusRelease(token)
+
+	video, state, status, err := loadTusUpload(token, user)
+	if err != nil {
+		return status, err
+	}
+
+	if state != jobstatus.StateDownloading {
+		return http.StatusConflict, errors.New("Upload is already complete")
+	}
+
+	offset, err := tusUploadOffset(video, state)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	requestOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, errors.New("Upload-Offset is missing or malformed")
+	}
+	if requestOffset != offset {
+		return http.StatusConflict, errors.New("Upload-Offset does not match the received data")
+	}
+
+	// The rest of the upload was admitted when it was created but the disk may
+	// have filled up since
+	status, err = checkUploadAdmission(video.uploadLength - offset)
+	if err != nil {
+		return status, err
+	}
+
+	// The status is not known if the upload is resumed after a restart
+	setVideoStatus(video, jobstatus.StateDownloading)
+
+	dlFile, err := os.OpenFile(video.dlPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer dlFile.Close()
+
+	// Everything that is received is kept even if the connection is lost so
+	// the client can resume from there, read one extra byte to detect overflow
+	remaining := video.uploadLength - offset
+	written, copyErr := io.Copy(dlFile, io.LimitReader(r.Body, remaining+1))
+
+	if written > remaining {
+		_ = dlFile.Truncate(offset)
+		return http.StatusRequestEntityTooLarge, errors.New("Upload exceeds Upload-Length")
+	}
+
+	offset += written
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if offset < video.uploadLength {
+		setTusExpires(w, time.Now())
+	}
+
+	if copyErr != nil {
+		return http.StatusInternalServerError, copyErr
+	}
+
+	if offset == video.uploadLength {
+		status, err := queueDownloadedVideo(video)
+		if err != nil {
+			jobs.Remove(video.token)
+			return status, err
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
+
+// > DELETE /uploads/tus/:token
+// Cancels an incomplete upload and removes the received data
+func tusDeleteHandler(w http.ResponseWriter, r *http.Request, user string) (int, error) {
+
+	vars := mux.Vars(r)
+	token := vars["token"]
+
+	if !tusAcquire(token) {
+		return http.StatusLocked, errors.New("Upload is receiving data")
+	}
+	defer tusRelease(token)
+
+	video, state, status, err := loadTusUpload(token, user)
+	if err != nil {
+		return status, err
+	}
+
+	if state != jobstatus.StateDownloading {
+		return http.StatusConflict, errors.New("Upload is already complete, delete the video instead")
+	}
+
+	err = os.Remove(video.dlPath)
+	logError(err, video.dlPath, "Delete download file")
+
+	err = os.Remove(video.manifestPath)
+	logError(err, video.manifestPath, "Delete manifest")
+
+	releaseVideo(video)
+	jobs.Remove(video.token)
+
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
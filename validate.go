@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"./transcode"
+)
+
+// Validation of downloaded videos before they are queued for processing, so
+// workers are not wasted on files that can't be transcoded and the client gets
+// an error instead of URLs that will never work.
+
+// Limits for uploaded videos, zero means unlimited
+var maxDuration float64
+var maxWidth int
+var maxHeight int
+
+// Parse a resolution limit `WIDTHxHEIGHT`, eg. "1920x1080"
+func parseResolution(resolution string) (int, int, error) {
+	parts := strings.Split(strings.ToLower(resolution), "x")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Malformed resolution %s, expected WIDTHxHEIGHT", resolution)
+	}
+
+	width, err := strconv.Atoi(parts[0])
+	if err != nil || width <= 0 {
+		return 0, 0, fmt.Errorf("Malformed resolution %s, expected positive numbers", resolution)
+	}
+	height, err := strconv.Atoi(parts[1])
+	if err != nil || height <= 0 {
+		return 0, 0, fmt.Errorf("Malformed resolution %s, expected positive numbers", resolution)
+	}
+
+	return width, height, nil
+}
+
+// Returns true if `width`x`height` is within the resolution limit in either
+// orientation, so portrait videos are not penalized
+func withinResolution(width int, height int) bool {
+	if maxWidth <= 0 || maxHeight <= 0 {
+		return true
+	}
+
+	long, short := width, height
+	if short > long {
+		long, short = short, long
+	}
+	maxLong, maxShort := maxWidth, maxHeight
+	if maxShort > maxLong {
+		maxLong, maxShort = maxShort, maxLong
+	}
+
+	return long <= maxLong && short <= maxShort
+}
+
+// Check that the trim times of `video` are within the `duration` of the video
+// in seconds. An end past the end of the video is dropped so a rounded up
+// duration from the client's player keeps the end untrimmed.
+func validateTrim(video *videoToTranscode, duration float64) (int, error) {
+	if duration <= 0.0 {
+		return http.StatusOK, nil
+	}
+
+	durationMs := int(math.Ceil(duration * 1000.0))
+	ranges := video.trim.Ranges
+	for i := range ranges {
+		if ranges[i].Start != nil && *ranges[i].Start >= durationMs {
+			return http.StatusUnprocessableEntity, fmt.Errorf("Trim start is past the end of the %g second video", duration)
+		}
+		if ranges[i].End != nil && *ranges[i].End >= durationMs {
+			ranges[i].End = nil
+		}
+	}
+
+	return http.StatusOK, nil
+}
+
+// Check that the downloaded file of `video` is a video that can be processed
+// Returns the HTTP status to respond with if it's not:
+// - 415 Unsupported Media Type if the file is not a video container at all
+// - 422 Unprocessable Entity if the video is broken or over the limits
+func validateDownloadedVideo(video *videoToTranscode) (int, error) {
+
+	container, err := transcode.SniffContainer(video.dlPath)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if container == "" {
+		return http.StatusUnsupportedMediaType, errors.New("The uploaded file is not a video")
+	}
+
+	// Use the external probe since it tells if the tools can decode the video
+	info, err := transcode.Probe(video.dlPath)
+	if err != nil {
+		log.Printf("%s: Probe failed: %s", video.srcPath, err.Error())
+		return http.StatusUnprocessableEntity, errors.New("The uploaded video could not be read")
+	}
+
+	stream := info.Video()
+	if stream == nil || stream.Codec == "" || stream.Width <= 0 || stream.Height <= 0 {
+		return http.StatusUnprocessableEntity, errors.New("The uploaded file has no video stream")
+	}
+
+	if maxDuration > 0.0 && info.Duration > maxDuration {
+		return http.StatusUnprocessableEntity, fmt.Errorf("The video is too long, the maximum is %g seconds", maxDuration)
+	}
+
+	status, err := validateTrim(video, info.Duration)
+	if err != nil {
+		return status, err
+	}
+
+	if !withinResolution(stream.Width, stream.Height) {
+		return http.StatusUnprocessableEntity, fmt.Errorf("The video resolution %dx%d is too large, the maximum is %dx%d",
+			stream.Width, stream.Height, maxWidth, maxHeight)
+	}
+
+	log.Printf("%s: Validated %s video: %s %dx%d, %.1f seconds", video.srcPath, container,
+		stream.Codec, stream.Width, stream.Height, info.Duration)
+	return http.StatusOK, nil
+}
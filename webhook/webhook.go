@@ -0,0 +1,193 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"../jobstatus"
+)
+
+// Header that contains the signature of the request body, see `Sign`
+const SignatureHeader = "X-Govitra-Signature"
+
+// Notification of a video reaching a new processing phase
+type Event struct {
+	Token string          `json:"token"`
+	Owner string          `json:"owner"`
+	Phase jobstatus.State `json:"phase"`
+
+	// Duration of the video in seconds, zero if not known yet
+	Duration float64 `json:"duration,omitempty"`
+
+	// Reason of the failure if `Phase` is "failed"
+	Error string `json:"error,omitempty"`
+
+	// Classification of the failure if known, see `jobstatus.ErrorKind`
+	ErrorKind string `json:"errorKind,omitempty"`
+
+	// When the phase was reached, events may arrive out of order
+	Time time.Time `json:"time"`
+
+	jobstatus.Outputs
+}
+
+// Delivers events to HTTP endpoints as signed JSON POST requests
+type Sender struct {
+
+	// HTTP client used for the requests
+	Client *http.Client
+
+	// Number of attempts before giving up on an event
+	Attempts int
+
+	// Wait time before the first retry, doubled for every following retry
+	Backoff time.Duration
+
+	secret []byte
+}
+
+// Create a new sender that signs the events with `secret`
+func NewSender(secret string) *Sender {
+	return &Sender{
+		Client:   &http.Client{Timeout: 30 * time.Second},
+		Attempts: 5,
+		Backoff:  2 * time.Second,
+		secret:   []byte(secret),
+	}
+}
+
+// Create a sender like `NewSender` for endpoints given by the users, it only
+// delivers to public addresses, see `NewPublicClient`
+func NewPublicSender(secret string) *Sender {
+	sender := NewSender(secret)
+	sender.Client = NewPublicClient(sender.Client.Timeout)
+	return sender
+}
+
+// Returns true if `ip` is not reachable from the public internet or refers to
+// the host itself: loopback, private, link-local, unspecified or multicast
+func isPrivateAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast()
+}
+
+// Dialer control that refuses to connect to addresses that are not public
+func publicOnlyControl(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || isPrivateAddress(ip) {
+		return fmt.Errorf("Refusing to connect to the non-public address %s", host)
+	}
+	return nil
+}
+
+// Returns an HTTP client that only connects to public addresses. The address
+// is checked when connecting after the host is resolved, so a host name can't
+// resolve to a public address when checked and to a private one when used.
+func NewPublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   publicOnlyControl,
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			// No proxy from the environment, it would be connected to instead
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// Returns the signature of `body`: "sha256=" followed by the hex encoded
+// HMAC-SHA256 of the body using the shared secret as the key
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the key to sign the events with derived from `masterSecret`: the hex
+// encoded HMAC-SHA256 of "webhook" using the master secret as the key. The
+// receivers get a key that can't be used in place of the master secret.
+func DeriveSecret(masterSecret string) string {
+	mac := hmac.New(sha256.New, []byte(masterSecret))
+	mac.Write([]byte("webhook"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns true if `signature` is a valid signature of `body`
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+// Try to deliver the event once, returns true if it's worth retrying on error
+func (self *Sender) post(url string, body []byte) (bool, error) {
+	request, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(SignatureHeader, Sign(string(self.secret), body))
+
+	response, err := self.Client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return false, nil
+	}
+
+	// Client errors won't go away by retrying, except for rate limiting
+	retry := response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("Webhook responded with %s", response.Status)
+}
+
+// Synchronously deliver `event` to `url`, retrying with exponential backoff
+func (self *Sender) Deliver(url string, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	backoff := self.Backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := self.post(url, body)
+		if err == nil || !retry || attempt >= self.Attempts {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Deliver `event` to `url` in the background, failures are only logged
+func (self *Sender) Send(url string, event Event) {
+	go func() {
+		err := self.Deliver(url, event)
+		if err != nil {
+			log.Printf("%s: Webhook %s to %s failed: %s", event.Token, event.Phase, url, err.Error())
+		}
+	}()
+}
@@ -0,0 +1,183 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"../jobstatus"
+)
+
+func TestSignVerify(t *testing.T) {
+	body := []byte(`{"token":"abc","phase":"done"}`)
+	signature := Sign("secret", body)
+
+	tests := []struct {
+		name      string
+		secret    string
+		body      []byte
+		signature string
+		valid     bool
+	}{
+		{"valid", "secret", body, signature, true},
+		{"wrong secret", "other", body, signature, false},
+		{"modified body", "secret", []byte(`{"token":"abc","phase":"failed"}`), signature, false},
+		{"missing prefix", "secret", body, signature[len("sha256="):], false},
+		{"empty signature", "secret", body, "", false},
+	}
+
+	for i, test := range tests {
+		if Verify(test.secret, test.body, test.signature) != test.valid {
+			t.Errorf("%d %s: expected valid %t", i, test.name, test.valid)
+		}
+	}
+}
+
+func TestDeriveSecret(t *testing.T) {
+	secret := DeriveSecret("master")
+	if secret == "master" || len(secret) != 64 {
+		t.Errorf("Expected a hex encoded SHA-256 digest, got %q", secret)
+	}
+	if DeriveSecret("master") != secret {
+		t.Errorf("Expected the derived secret to be stable")
+	}
+	if DeriveSecret("other") == secret {
+		t.Errorf("Expected different master secrets to derive different secrets")
+	}
+}
+
+func TestDeliverSigned(t *testing.T) {
+	var received Event
+	var validSignature bool
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		validSignature = Verify("secret", body, r.Header.Get(SignatureHeader))
+		_ = json.Unmarshal(body, &received)
+	}))
+	defer server.Close()
+
+	event := Event{Token: "abc", Owner: "user", Phase: jobstatus.StateDone, Time: time.Now()}
+	err := NewSender("secret").Deliver(server.URL, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !validSignature {
+		t.Errorf("Expected the request to be signed with the secret")
+	}
+	if received.Token != "abc" || received.Owner != "user" || received.Phase != jobstatus.StateDone {
+		t.Errorf("Expected the event to be delivered, got %+v", received)
+	}
+}
+
+func TestDeliverRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		attempts int32
+		fails    bool
+	}{
+		{"success", []int{200}, 1, false},
+		{"server errors", []int{500, 503, 204}, 3, false},
+		{"rate limited", []int{429, 200}, 2, false},
+		{"client error", []int{400, 200}, 1, true},
+		{"not found", []int{404, 200}, 1, true},
+		{"out of attempts", []int{500, 500, 500, 500, 200}, 3, true},
+	}
+
+	for i, test := range tests {
+		var attempts int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempt := atomic.AddInt32(&attempts, 1)
+			w.WriteHeader(test.statuses[attempt-1])
+		}))
+
+		sender := NewSender("secret")
+		sender.Attempts = 3
+		sender.Backoff = time.Millisecond
+		err := sender.Deliver(server.URL, Event{Token: "abc"})
+		server.Close()
+
+		if (err != nil) != test.fails {
+			t.Errorf("%d %s: expected failure %t, got error %v", i, test.name, test.fails, err)
+		}
+		if attempts != test.attempts {
+			t.Errorf("%d %s: %d attempts, expected %d", i, test.name, attempts, test.attempts)
+		}
+	}
+}
+
+func TestDeliverBackoff(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	// Waits 10ms and 20ms between the three attempts
+	sender := NewSender("secret")
+	sender.Attempts = 3
+	sender.Backoff = 10 * time.Millisecond
+
+	start := time.Now()
+	err := sender.Deliver(server.URL, Event{Token: "abc"})
+	elapsed := time.Since(start)
+
+	if err == nil || attempts != 3 {
+		t.Errorf("Expected 3 failed attempts, got %d with error %v", attempts, err)
+	}
+	if elapsed < 30*time.Millisecond {
+		t.Errorf("Expected at least 30ms of backoff, took %s", elapsed)
+	}
+}
+
+func TestPublicSenderRefusesPrivateAddresses(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+	}))
+	defer server.Close()
+
+	sender := NewPublicSender("secret")
+	sender.Attempts = 1
+	err := sender.Deliver(server.URL, Event{Token: "abc"})
+	if err == nil || attempts != 0 {
+		t.Errorf("Expected the loopback server to be refused, got %d requests and error %v", attempts, err)
+	}
+}
+
+func TestIsPrivateAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		private bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"0.0.0.0", true},
+		{"::", true},
+		{"224.0.0.1", true},
+		{"::ffff:127.0.0.1", true},
+		{"8.8.8.8", false},
+		{"172.32.0.1", false},
+		{"2001:4860:4860::8888", false},
+	}
+
+	for i, test := range tests {
+		if isPrivateAddress(net.ParseIP(test.address)) != test.private {
+			t.Errorf("%d %s: expected private %t", i, test.address, test.private)
+		}
+	}
+}